@@ -1,4 +1,5 @@
 #!/bin/sh
-GOOS=windows GOARCH=amd64 go build -o xml2sav-win64.exe
-GOOS=windows GOARCH=386 go build -o xml2sav-win32.exe
-GOOS=linux GOARCH=amd64 go build -o xml2sav-linux64
+cd "$(dirname "$0")" || exit 1
+GOOS=windows GOARCH=amd64 go build -o xml2sav-win64.exe ./cmd/xml2sav
+GOOS=windows GOARCH=386 go build -o xml2sav-win32.exe ./cmd/xml2sav
+GOOS=linux GOARCH=amd64 go build -o xml2sav-linux64 ./cmd/xml2sav
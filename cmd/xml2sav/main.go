@@ -0,0 +1,152 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/j0ran/xml2sav"
+)
+
+var opts = xml2sav.DefaultOptions()
+var pause = false
+var noLogToFile = false
+var toCsv = false
+var zsav = false
+var uncompressed = false
+var inspectCases = 0
+var labelLang = ""
+var register func()
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: xml2sav [options] <file.xsav>")
+		fmt.Fprintln(os.Stderr, "       xml2sav [options] sav2xsav <file.sav>")
+		fmt.Fprintln(os.Stderr, "       xml2sav [options] inspect <file.sav>")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flag.PrintDefaults()
+	}
+	flag.BoolVar(&pause, "pause", pause, "pause and wait for enter after finsishing")
+	flag.BoolVar(&noLogToFile, "nolog", noLogToFile, "don't write log to file")
+	flag.BoolVar(&opts.SinglePass, "single", opts.SinglePass, "don't determine lengths of string variables")
+	flag.BoolVar(&toCsv, "csv", toCsv, "convert to csv")
+	flag.BoolVar(&zsav, "zsav", zsav, "write zlib compressed zsav files")
+	flag.BoolVar(&uncompressed, "uncompressed", uncompressed, "write uncompressed sav files")
+	flag.IntVar(&inspectCases, "cases", inspectCases, "number of cases to show with inspect")
+	flag.StringVar(&opts.Locale, "locale", opts.Locale, "locale of month names in dates: en, nl, de or fr")
+	flag.StringVar(&labelLang, "lang", labelLang, "preferred languages of labels, like fr,en")
+	flag.BoolVar(&opts.WriteInferredDict, "dict", opts.WriteInferredDict, "write the inferred dictionary of a sav without dict to an xml file")
+	flag.BoolVar(&opts.IgnoreMissingVar, "ignore", opts.IgnoreMissingVar, "ignore values in cases that are not declared in dictronary")
+	flag.BoolVar(&opts.Strict, "strict", opts.Strict, "fail on any problem in the input")
+	flag.IntVar(&opts.MaxErrors, "max-errors", opts.MaxErrors, "number of problems of any kind to tolerate per sav")
+}
+
+func main() {
+	startTime := time.Now()
+
+	fmt.Println("xml2sav 2.1  Copyright (C) 2016-2017  A.J. Jessurun")
+	fmt.Println("This program comes with ABSOLUTELY NO WARRANTY.")
+	fmt.Println("This is free software, and you are welcome to redistribute it")
+	fmt.Println("under certain conditions. See the file COPYING.txt.")
+
+	flag.Parse()
+	command := ""
+	args := flag.Args()
+	if len(args) == 2 {
+		command = args[0]
+		args = args[1:]
+	}
+	if len(args) != 1 || (command != "" && command != "sav2xsav" && command != "inspect") ||
+		(zsav && uncompressed) || opts.MaxErrors < 0 {
+		if register != nil { // register file association
+			register()
+		}
+		fmt.Println()
+		flag.Usage()
+		os.Exit(1)
+	}
+	if opts.Strict && (opts.IgnoreMissingVar || opts.MaxErrors > 0) {
+		fmt.Fprintln(os.Stderr, "The -strict option can not be combined with -ignore or -max-errors")
+		os.Exit(1)
+	}
+	if toCsv && (opts.Strict || opts.IgnoreMissingVar || opts.MaxErrors > 0) {
+		fmt.Fprintln(os.Stderr, "The -strict, -ignore and -max-errors options can not be used with -csv")
+		os.Exit(1)
+	}
+	filename := args[0]
+
+	if zsav {
+		opts.Compression = xml2sav.SPSS_COMPRESS_ZLIB
+	} else if uncompressed {
+		opts.Compression = xml2sav.SPSS_COMPRESS_NONE
+	}
+	for _, lang := range strings.Split(labelLang, ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			opts.Languages = append(opts.Languages, lang)
+		}
+	}
+
+	if !noLogToFile && command != "inspect" {
+		logfile, err := os.Create(filename[:len(filename)-len(path.Ext(filename))] + ".log")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, logfile))
+	}
+
+	var err error
+	switch {
+	case command == "sav2xsav":
+		log.Println("Reading", filename)
+		err = xml2sav.ConvertSavToXSav(filename)
+	case command == "inspect":
+		err = xml2sav.InspectSavFile(os.Stdout, filename, inspectCases)
+	case toCsv:
+		err = xml2sav.ConvertXSavToCsv(filename, opts)
+	default:
+		err = xml2sav.ConvertXSav(filename, opts)
+	}
+	var tolerated *xml2sav.ToleratedError
+	if err != nil && !errors.As(err, &tolerated) {
+		log.Fatalln(err)
+	}
+
+	log.Printf("Done in %v\n", time.Now().Sub(startTime))
+	if tolerated != nil {
+		log.Println(tolerated)
+	}
+
+	if pause {
+		fmt.Println("Press enter to continue.")
+		var line string
+		fmt.Scanln(&line)
+	}
+	if tolerated != nil {
+		os.Exit(2)
+	}
+}
@@ -17,7 +17,7 @@ GNU General Public License for more details.
 You should have received a copy of the GNU General Public License
 along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
 */
-package main
+package xml2sav
 
 import (
 	"bufio"
@@ -55,40 +55,143 @@ func (c *CsvWriter) Flush() error {
 	return c.BufIO.Flush()
 }
 
-func parseXSavToCsv(reader io.Reader, filename string) error {
+// AddVar adds a column for a variable
+func (c *CsvWriter) AddVar(name string) error {
+	if _, found := c.Vars[name]; found {
+		return &DuplicateVarError{name}
+	}
+	v := &CsvVar{Name: name}
+	c.Dict = append(c.Dict, v)
+	c.Vars[name] = v
+	return nil
+}
+
+// ParseXSavToCsv converts the sav elements of an xsav document to csv files.
+// Variables of type multi get a 0/1 column per option, like in sav files. The
+// columns of a sav without a dict come from the lengths of pass 1, without them
+// such a sav is a NoDictError. Errors are returned as a PosError.
+func ParseXSavToCsv(reader io.Reader, filename string, lengths VarLengths) (err error) {
 	basename := strings.TrimSuffix(filename, filepath.Ext(filename))
 	var csv *CsvWriter
 	var f *os.File
-	decoder := xml.NewDecoder(reader)
+	var savname string
+	var cases, caseNr int32
+	var multis map[string]*multiVar
+	var labelsets map[string][]*labelXML
+	var dictDone bool
+	var csvfilename string
+
+	// startCases writes the header, after inferring the columns when there was
+	// no dictionary
+	startCases := func(inferred bool) error {
+		dictDone = true
+		if inferred {
+			if lengths == nil {
+				return &NoDictError{savname}
+			}
+			log.Printf("Sav %s has no dictionary, inferring it from the values\n", savname)
+			for _, name := range lengths.VarNames(savname) {
+				if err := csv.AddVar(name); err != nil {
+					return err
+				}
+			}
+		}
+		header := make([]string, len(csv.Dict))
+		for i := range csv.Dict {
+			header[i] = csv.Dict[i].Name
+		}
+		return csv.Write(header)
+	}
+
+	decoder := newPositionDecoder(reader)
+	defer func() {
+		err = decoder.errorAt(err, savname, caseNr)
+	}()
+	// an unfinished csv file is closed and removed
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(csvfilename)
+		}
+	}()
 	for {
 		token, err := decoder.Token()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 		switch t := token.(type) {
 		case xml.StartElement:
 			switch t.Name.Local {
 			case "sav":
-				savname := getAttr(&t, "name")
-				csvfilename := fmt.Sprintf("%s_%s.csv", basename, savname)
+				if savname, err = getAttr(&t, "name"); err != nil {
+					return err
+				}
+				cases = 0
+				csvfilename = fmt.Sprintf("%s_%s.csv", basename, savname)
 				log.Println("Writing", csvfilename)
 				f, err = os.Create(csvfilename)
 				if err != nil {
 					return err
 				}
 				csv = NewCsvWriter(f)
+				multis = make(map[string]*multiVar)
+				labelsets = make(map[string][]*labelXML)
+				dictDone = false
+			case "labelset":
+				labelsetxml := new(labelSetXML)
+				if err = decoder.DecodeElement(labelsetxml, &t); err != nil {
+					return err
+				}
+				labelsets[labelsetxml.ID] = labelsetxml.Labels
 			case "var":
-				v := new(CsvVar)
-				v.Name = getAttr(&t, "name")
-				csv.Dict = append(csv.Dict, v)
-				if _, found := csv.Vars[v.Name]; found {
-					return fmt.Errorf("Variable %s already defined", v.Name)
+				name, err := getAttr(&t, "name")
+				if err != nil {
+					return err
+				}
+				if _, found := multis[name]; found {
+					return &DuplicateVarError{name}
 				}
-				csv.Vars[v.Name] = v
+				if typ, _ := getAttr(&t, "type"); typ != "multi" {
+					if err = csv.AddVar(name); err != nil {
+						return err
+					}
+					continue
+				}
+				if _, found := csv.Vars[name]; found {
+					return &DuplicateVarError{name}
+				}
+				varxml := new(varXML)
+				if err = decoder.DecodeElement(varxml, &t); err != nil {
+					return err
+				}
+				if hasAttr(&t, "labels") {
+					labels, found := labelsets[varxml.LabelSet]
+					if !found {
+						return fmt.Errorf("Variable %s refers to undefined label set %s", varxml.Name, varxml.LabelSet)
+					}
+					varxml.Labels = append(append([]*labelXML(nil), labels...), varxml.Labels...)
+				}
+				multi, dict, err := newMultiVar(varxml)
+				if err != nil {
+					return err
+				}
+				for _, v := range dict {
+					if err = csv.AddVar(v.Name); err != nil {
+						return err
+					}
+				}
+				multis[name] = multi
 			case "case":
+				cases++
+				caseNr = cases
+				if !dictDone {
+					if err = startCases(true); err != nil {
+						return err
+					}
+				}
 				for _, v := range csv.Dict {
 					v.Value = ""
 				}
@@ -97,29 +200,54 @@ func parseXSavToCsv(reader io.Reader, filename string) error {
 				if err = decoder.DecodeElement(&valxml, &t); err != nil {
 					return err
 				}
+				if multi, found := multis[valxml.Name]; found {
+					selected, unknown := multi.split(valxml.Value)
+					for _, option := range unknown {
+						log.Printf("%s%s - option ignored\n", location(savname, caseNr, decoder.Line, decoder.Column),
+							&ValueError{valxml.Name, valxml.Value, fmt.Errorf("Unknown option %s", option)})
+					}
+					for _, member := range multi.members {
+						csv.Vars[member].Value = "0"
+						if selected[member] {
+							csv.Vars[member].Value = "1"
+						}
+					}
+					continue
+				}
 				v, found := csv.Vars[valxml.Name]
 				if !found {
-					return fmt.Errorf("Found a value for non existing variable %s", valxml.Name)
+					return &UnknownVarError{valxml.Name}
 				}
 				v.Value = valxml.Value
 			}
 		case xml.EndElement:
 			switch t.Name.Local {
 			case "sav":
-				csv.Flush()
-				f.Close()
+				if !dictDone {
+					if err = startCases(true); err != nil {
+						return err
+					}
+				}
+				if err = csv.Flush(); err != nil {
+					return err
+				}
+				if err = f.Close(); err != nil {
+					return err
+				}
+				f = nil
 			case "dict":
-				header := make([]string, len(csv.Dict))
-				for i := range csv.Dict {
-					header[i] = csv.Dict[i].Name
+				if err = startCases(false); err != nil {
+					return err
 				}
-				csv.Write(header)
 			case "case":
 				record := make([]string, len(csv.Dict))
 				for i := range csv.Dict {
 					record[i] = csv.Dict[i].Value
 				}
-				csv.Write(record)
+				if err = csv.Write(record); err != nil {
+					return err
+				}
+				caseNr = 0
 			}
 		}
 	}
@@ -0,0 +1,114 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// csvOutput converts an xsav document with a sav named s to csv in a temporary
+// directory and returns the csv
+func csvOutput(t *testing.T, xsav string) string {
+	dir := t.TempDir()
+	lengths, err := FindVarLengths(strings.NewReader(xsav), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ParseXSavToCsv(strings.NewReader(xsav), filepath.Join(dir, "c.xsav"), lengths); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "c_s.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCsvMultiVar(t *testing.T) {
+	got := csvOutput(t, `<spss><sav name="s"><dict>
+<labelset id="yn"><label value="y">Yes</label><label value="n">No</label></labelset>
+<var name="id" type="numeric"/>
+<var name="q5" type="multi"><label value="1">Apple</label><label value="2">Pear</label><label value="5">Banana</label></var>
+<var name="q6" type="multi" template="fav{value}" separator="," labels="yn"/>
+</dict>
+<case><val name="id">1</val><val name="q5">2;5</val><val name="q6">y, n</val></case>
+<case><val name="id">2</val><val name="q5">1;9</val></case>
+</sav></spss>`)
+	want := "id,q5_1,q5_2,q5_5,favy,favn\n1,0,1,1,1,1\n2,1,0,0,,\n"
+	if got != want {
+		t.Errorf("csv is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCsvMultiVarDuplicateName(t *testing.T) {
+	xsav := `<spss><sav name="s"><dict><var name="q5" type="numeric"/>
+<var type="multi" name="q5"><label value="1">A</label><label value="2">B</label></var>
+</dict></sav></spss>`
+	err := ParseXSavToCsv(strings.NewReader(xsav), filepath.Join(t.TempDir(), "d.xsav"), nil)
+	var duplicate *DuplicateVarError
+	if !errors.As(err, &duplicate) || duplicate.Name != "q5" {
+		t.Errorf("error %v, want a DuplicateVarError for q5", err)
+	}
+}
+
+func TestCsvInferDict(t *testing.T) {
+	got := csvOutput(t, `<spss><sav name="s">
+<case><val name="a">1</val><val name="b">x</val></case>
+<case><val name="c">2,5</val><val name="a">2</val></case>
+</sav></spss>`)
+	want := "a,b,c\n1,x,\n2,,\"2,5\"\n"
+	if got != want {
+		t.Errorf("csv is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestConvertXSavToCsvPass1(t *testing.T) {
+	xsav := `<spss><sav name="d"><dict><var name="a" type="numeric"/></dict>
+<case><val name="a">1</val></case></sav>
+<sav name="s"><case><val name="b">x</val></case></sav></spss>`
+	filename := filepath.Join(t.TempDir(), "p.xsav")
+	if err := os.WriteFile(filename, []byte(xsav), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.SinglePass = true
+	var noDict *NoDictError
+	if err := ConvertXSavToCsv(filename, opts); !errors.As(err, &noDict) || noDict.Sav != "s" {
+		t.Errorf("single pass gives error %v, want a NoDictError for s", err)
+	}
+
+	if err := ConvertXSavToCsv(filename, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"p_d.csv": "a\n1\n", "p_s.csv": "b\nx\n"} {
+		b, err := os.ReadFile(filepath.Join(filepath.Dir(filename), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s is\n%s\nwant\n%s", name, b, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+Package xml2sav writes SPSS system files and converts xsav documents to them.
+
+ConvertXSav converts an xsav file with the given Options, the way the xml2sav
+command does. ParseXSav and FindVarLengths do the same for an xsav document
+that is read from an io.Reader.
+
+Sav files can also be written directly with a SpssWriter. Add the variables
+of the dictionary with AddVar and write the dictionary with Start. Then for
+every case, set the values with SetVar and write them with WriteCase. Values
+are given as text and parsed according to the Kind of the variable. Finish
+completes the file, it does not close the writer.
+
+	out := xml2sav.NewSpssWriter(f)
+	out.AddVar(&xml2sav.Var{Name: "id", Type: xml2sav.SPSS_NUMERIC,
+		Print: xml2sav.SPSS_FMT_F, Width: 8, Measure: xml2sav.SPSS_MLVL_NOM})
+	out.AddVar(&xml2sav.Var{Name: "name", Type: 20, Kind: xml2sav.KindString,
+		Print: xml2sav.SPSS_FMT_A, Width: 20, Measure: xml2sav.SPSS_MLVL_NOM})
+	out.Start("Example")
+	out.ClearCase()
+	out.SetVar("id", "1")
+	out.SetVar("name", "Ann")
+	out.WriteCase()
+	out.Finish()
+
+Errors are returned instead of logged, with typed errors for the problems in
+the input: DuplicateVarError, UnknownVarError, MissingAttrError,
+LabelValueError and WidthError. Start, WriteCase and Finish return the errors
+of writing the file. The example above leaves out the error handling. Values
+that can not be parsed are logged and written as missing, unless
+SpssWriter.Strict is set. SpssWriter.MaxErrors tolerates that many problems of
+any kind, and counts them in SpssWriter.Problems.
+
+ParseXSav, FindVarLengths and ParseXSavToCsv wrap their errors in a PosError
+with the sav, the case and the line and column in the xml. The typed error is
+available through errors.As. SetVarAt remembers the position of a value for
+the messages of WriteCase.
+
+SpssReader reads sav and zsav files, including everything SpssWriter writes.
+*/
+package xml2sav
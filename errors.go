@@ -0,0 +1,153 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import "fmt"
+
+// DuplicateVarError is returned when a variable is added to a dictionary that
+// already has a variable with that name
+type DuplicateVarError struct {
+	Name string
+}
+
+func (e *DuplicateVarError) Error() string {
+	return fmt.Sprintf("Adding duplicate variable named %s", e.Name)
+}
+
+// UnknownVarError is returned when a case has a value for a variable that is not
+// in the dictionary
+type UnknownVarError struct {
+	Name string
+}
+
+func (e *UnknownVarError) Error() string {
+	return fmt.Sprintf("Can not find the variable named in dictionary %s", e.Name)
+}
+
+// MissingAttrError is returned when an element lacks a required attribute
+type MissingAttrError struct {
+	Element string
+	Attr    string
+}
+
+func (e *MissingAttrError) Error() string {
+	return fmt.Sprintf("%s element does not have a %s attribute", e.Element, e.Attr)
+}
+
+// LabelValueError is returned when the value of a value label does not match
+// the type of the variable
+type LabelValueError struct {
+	Var   string
+	Value string
+}
+
+func (e *LabelValueError) Error() string {
+	return fmt.Sprintf("Value '%s' of a label of variable %s is not a number", e.Value, e.Var)
+}
+
+// WidthError is returned when a string variable is wider than allowed
+type WidthError struct {
+	Var   string
+	Width int
+	Max   int
+}
+
+func (e *WidthError) Error() string {
+	return fmt.Sprintf("Maximum length for a variable is %d, %s is %d", e.Max, e.Var, e.Width)
+}
+
+// NoDictError is returned by ParseXSavToCsv for a sav without a dict when no
+// lengths of pass 1 are given to infer its columns from
+type NoDictError struct {
+	Sav string
+}
+
+func (e *NoDictError) Error() string {
+	return fmt.Sprintf("The dictionary of sav %s can not be inferred in a single pass", e.Sav)
+}
+
+// PosError is an error at a position in an xsav document. Case is the ordinal
+// of the case in the sav, zero outside the cases.
+type PosError struct {
+	Sav    string
+	Case   int32
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *PosError) Error() string {
+	return location(e.Sav, e.Case, e.Line, e.Column) + e.Err.Error()
+}
+
+func (e *PosError) Unwrap() error {
+	return e.Err
+}
+
+// ValueError is a value in a case that can not be parsed
+type ValueError struct {
+	Var   string
+	Value string
+	Err   error
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("Problem parsing value for %s: %s", e.Var, e.Err)
+}
+
+func (e *ValueError) Unwrap() error {
+	return e.Err
+}
+
+// TruncateError is a value of a string variable that is longer than its width
+type TruncateError struct {
+	Var   string
+	Value string
+	Width int
+}
+
+func (e *TruncateError) Error() string {
+	return fmt.Sprintf("Value of %s is longer than its width %d", e.Var, e.Width)
+}
+
+// MaxErrorsError is returned when a sav has more problems than SpssWriter.MaxErrors
+// allows. Err is the problem that exceeded the maximum.
+type MaxErrorsError struct {
+	Max int
+	Err error
+}
+
+func (e *MaxErrorsError) Error() string {
+	return fmt.Sprintf("More than %d problems, giving up at: %s", e.Max, e.Err)
+}
+
+func (e *MaxErrorsError) Unwrap() error {
+	return e.Err
+}
+
+// ToleratedError is returned by ParseXSav with an error budget when all sav
+// files were written, but problems in the input were tolerated to do so
+type ToleratedError struct {
+	Problems int
+}
+
+func (e *ToleratedError) Error() string {
+	return fmt.Sprintf("%d problems in the input were tolerated, see the log", e.Problems)
+}
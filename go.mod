@@ -0,0 +1,5 @@
+module github.com/j0ran/xml2sav
+
+go 1.18
+
+require golang.org/x/sys v0.20.0
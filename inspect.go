@@ -0,0 +1,227 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var compressionNames = map[int32]string{
+	SPSS_COMPRESS_NONE:     "none",
+	SPSS_COMPRESS_BYTECODE: "bytecode",
+	SPSS_COMPRESS_ZLIB:     "zlib",
+}
+
+var subtypeNames = map[int32]string{
+	3:  "machine integer info",
+	4:  "machine floating point info",
+	7:  "multiple response sets",
+	11: "variable display parameters",
+	13: "long variable names",
+	14: "very long strings",
+	16: "extended number of cases",
+	17: "datafile attributes",
+	18: "variable attributes",
+	19: "extended multiple response sets",
+	20: "character encoding",
+	21: "long string value labels",
+	22: "long string missing values",
+}
+
+var alignmentNames = []string{"left", "right", "center"}
+
+func describeRecord(r RecordInfo) string {
+	switch r.Type {
+	case 0:
+		return "header " + r.Name
+	case 2:
+		if r.Name == "" {
+			return "variable, string continuation"
+		}
+		return "variable " + r.Name
+	case 3:
+		return "value labels"
+	case 4:
+		return "value label variables"
+	case 6:
+		return "documents"
+	case 7:
+		if name, found := subtypeNames[r.Subtype]; found {
+			return fmt.Sprintf("extension %d, %s", r.Subtype, name)
+		}
+		return fmt.Sprintf("extension %d", r.Subtype)
+	case 999:
+		return "end of dictionary"
+	}
+	return "unknown"
+}
+
+// inspectSav writes a description of the records, the dictionary and the
+// first cases of a sav file
+func inspectSav(w io.Writer, in *SpssReader, cases int) error {
+	fmt.Fprintln(w, "Header")
+	fmt.Fprintf(w, "  prod_name          %s\n", in.Product)
+	fmt.Fprintf(w, "  layout_code        %d\n", in.Layout)
+	fmt.Fprintf(w, "  nominal_case_size  %d\n", in.CaseSize)
+	fmt.Fprintf(w, "  compression        %d (%s)\n", in.Compression, compressionNames[in.Compression])
+	fmt.Fprintf(w, "  weight_index       %d\n", in.weightIndex)
+	fmt.Fprintf(w, "  ncases             %d\n", in.Count)
+	fmt.Fprintf(w, "  bias               %v\n", in.Bias)
+	fmt.Fprintf(w, "  creation           %s\n", in.Created)
+	fmt.Fprintf(w, "  file_label         %s\n", in.FileLabel)
+	if in.Encoding != "" {
+		fmt.Fprintf(w, "  encoding           %s\n", in.Encoding)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Records")
+	fmt.Fprintln(w, "  offset     length  type")
+	for i := 0; i < len(in.Records); i++ {
+		r := in.Records[i]
+		desc := describeRecord(r)
+		if r.Type == 2 && r.Name == "" { // combine the continuations of a long string
+			n := 1
+			for ; i+1 < len(in.Records) && in.Records[i+1].Type == 2 && in.Records[i+1].Name == ""; i++ {
+				r.Length += in.Records[i+1].Length
+				n++
+			}
+			desc = fmt.Sprintf("%s x%d", desc, n)
+		}
+		fmt.Fprintf(w, "  %-10d %-7d %-5d %s\n", r.Offset, r.Length, r.Type, desc)
+	}
+	fmt.Fprintf(w, "  %-10d                case data\n", in.DataOffset)
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Variables")
+	records := in.records
+	for _, v := range in.Dict {
+		var specs []string
+		for _, r := range records[:v.Segments] {
+			specs = append(specs, FormatSpec(byte(r.print>>16), byte(r.print>>8), byte(r.print)))
+		}
+		r := records[0]
+		records = records[v.Segments:]
+
+		fmt.Fprintf(w, "  %d %s (%s)\n", v.Index, v.ShortName, v.Name)
+		if v.Type > 0 {
+			fmt.Fprintf(w, "    type       string %d\n", v.Type)
+		} else {
+			fmt.Fprintln(w, "    type       numeric")
+		}
+		fmt.Fprintf(w, "    format     %s\n", strings.Join(specs, " "))
+		fmt.Fprintf(w, "    segments   %d\n", v.Segments)
+		alignment := fmt.Sprint(r.align)
+		if int(r.align) >= 0 && int(r.align) < len(alignmentNames) {
+			alignment = alignmentNames[r.align]
+		}
+		fmt.Fprintf(w, "    display    %s, width %d, %s\n", measureName(v.Measure), r.width, alignment)
+		if v.Role != SPSS_ROLE_INPUT && int(v.Role) < len(roleNames) {
+			fmt.Fprintf(w, "    role       %s\n", roleNames[v.Role])
+		}
+		if v == in.Weight {
+			fmt.Fprintln(w, "    weight")
+		}
+		if v.Label != "" {
+			fmt.Fprintf(w, "    label      %s\n", v.Label)
+		}
+		if v.HasMissingRange {
+			fmt.Fprintf(w, "    missing    %s thru %s\n", v.MissingLow, v.MissingHigh)
+		}
+		for _, m := range v.Missing {
+			fmt.Fprintf(w, "    missing    %s\n", m)
+		}
+		for _, l := range v.Labels {
+			fmt.Fprintf(w, "    value      %s = %s\n", l.Value, l.Desc)
+		}
+		for _, a := range v.Attributes {
+			fmt.Fprintf(w, "    attribute  %s = %s\n", a.Name, a.Value)
+		}
+	}
+
+	for _, m := range in.MRSets {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Multiple response set %s\n", m.Name)
+		if m.Dichotomy {
+			fmt.Fprintf(w, "  dichotomy, counted value %s\n", m.CountedValue)
+		} else {
+			fmt.Fprintln(w, "  category")
+		}
+		if m.Label != "" {
+			fmt.Fprintf(w, "  label      %s\n", m.Label)
+		}
+		for _, v := range m.Vars {
+			fmt.Fprintf(w, "  member     %s\n", v.Name)
+		}
+	}
+
+	if len(in.Attributes) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Datafile attributes")
+		for _, a := range in.Attributes {
+			fmt.Fprintf(w, "  %s = %s\n", a.Name, a.Value)
+		}
+	}
+
+	if len(in.Documents) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Documents")
+		for _, d := range in.Documents {
+			fmt.Fprintf(w, "  %s\n", d)
+		}
+	}
+
+	for i := 0; i < cases; i++ {
+		err := in.ReadCase()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Case %d\n", i+1)
+		for _, v := range in.Dict {
+			if v.HasValue {
+				fmt.Fprintf(w, "  %s = %s\n", v.Name, v.Value)
+			} else {
+				fmt.Fprintf(w, "  %s missing\n", v.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// InspectSavFile writes the description of a sav file to w
+func InspectSavFile(w io.Writer, filename string, cases int) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in, err := NewSpssReader(f)
+	if err != nil {
+		return err
+	}
+	return inspectSav(w, in, cases)
+}
@@ -0,0 +1,69 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInspectOffsets(t *testing.T) {
+	b := writeTestFile(t, SPSS_COMPRESS_BYTECODE, 2)
+	r, err := NewSpssReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records follow each other without gaps up to the case data
+	var offset int64
+	for _, rec := range r.Records {
+		if rec.Offset != offset {
+			t.Errorf("%s is at %d, want %d", describeRecord(rec), rec.Offset, offset)
+		}
+		offset = rec.Offset + rec.Length
+	}
+	if offset != r.DataOffset {
+		t.Errorf("records end at %d, case data is at %d", offset, r.DataOffset)
+	}
+	if h := r.Records[0]; h.Type != 0 || h.Length != 176 {
+		t.Errorf("first record is %s of %d bytes, want the header of 176 bytes", describeRecord(h), h.Length)
+	}
+	if end := r.Records[len(r.Records)-1]; end.Type != 999 || end.Length != 8 {
+		t.Errorf("last record is %s of %d bytes, want the end of the dictionary of 8 bytes", describeRecord(end), end.Length)
+	}
+
+	var out bytes.Buffer
+	if err = inspectSav(&out, r, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range r.Records {
+		if rec.Type == 2 && rec.Name == "" {
+			continue // combined with the first segment
+		}
+		if line := fmt.Sprintf("  %-10d %-7d %-5d %s\n", rec.Offset, rec.Length, rec.Type, describeRecord(rec)); !strings.Contains(out.String(), line) {
+			t.Errorf("output lacks %q:\n%s", line, out.String())
+		}
+	}
+	if line := fmt.Sprintf("  %-10d                case data\n", r.DataOffset); !strings.Contains(out.String(), line) {
+		t.Errorf("output lacks %q", line)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// Options holds the settings of the conversion of xsav files. IgnoreMissingVar,
+// Strict and MaxErrors only apply to sav files, not to csv.
+type Options struct {
+	MaxStringLength     int      // Maximum width of string variables
+	DefaultStringLength int      // Width of string variables without width when there is no pass 1
+	SinglePass          bool     // Skip pass 1 that determines the widths of string variables
+	Compression         int32    // SPSS_COMPRESS_NONE, SPSS_COMPRESS_BYTECODE or SPSS_COMPRESS_ZLIB
+	IgnoreMissingVar    bool     // Ignore values of variables that are not in the dictionary
+	Locale              string   // Locale of month names in dates: en, nl, de or fr
+	Languages           []string // Preferred languages of labels, in order
+	WriteInferredDict   bool     // Write the inferred dictionary of a sav without dict to a file
+	Strict              bool     // Fail on every problem in the input
+	MaxErrors           int      // Number of problems to tolerate per sav, 0 for the default
+}
+
+// DefaultOptions returns the options the xml2sav command uses by default
+func DefaultOptions() *Options {
+	return &Options{
+		MaxStringLength:     DefaultMaxStringLength,
+		DefaultStringLength: 2048,
+		Compression:         SPSS_COMPRESS_BYTECODE,
+		Locale:              "en",
+	}
+}
+
+// ConvertXSav converts an xsav file to sav files, named after the xsav file and
+// its sav elements
+func ConvertXSav(filename string, opts *Options) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	log.Println("Reading", filename)
+	var lengths VarLengths
+	if !opts.SinglePass {
+		log.Println("Pass 1, determining maximum length of strings")
+		if lengths, err = FindVarLengths(in, opts); err != nil {
+			return err
+		}
+		in.Seek(0, io.SeekStart) // Rewind for second read
+		log.Println("Pass 2, generating sav files")
+	}
+
+	return ParseXSav(in, filename, lengths, opts)
+}
+
+// ConvertXSavToCsv converts an xsav file to csv files, named after the xsav file
+// and its sav elements. Pass 1 is only needed for sav elements without a dict,
+// so it only runs when such a sav is found. The conversion then starts over,
+// and the csv files before that sav are written again.
+func ConvertXSavToCsv(filename string, opts *Options) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	log.Println("Reading", filename)
+	err = ParseXSavToCsv(in, filename, nil)
+	var noDict *NoDictError
+	if opts.SinglePass || !errors.As(err, &noDict) {
+		return err
+	}
+
+	log.Printf("Sav %s has no dictionary, starting over\n", noDict.Sav)
+	in.Seek(0, io.SeekStart)
+	log.Println("Pass 1, determining the variables")
+	lengths, err := FindVarLengths(in, opts)
+	if err != nil {
+		return err
+	}
+	in.Seek(0, io.SeekStart) // Rewind for second read
+	log.Println("Pass 2, generating csv files")
+	return ParseXSavToCsv(in, filename, lengths)
+}
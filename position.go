@@ -0,0 +1,111 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// positionReader remembers where the lines start in the xml that is read, so
+// the line and column of an offset of the decoder can be found. Only the line
+// starts after the last asked offset are kept.
+type positionReader struct {
+	r        io.Reader
+	read     int64   // number of bytes read
+	newlines []int64 // offsets of the newlines after the current line start
+	line     int     // current line
+	start    int64   // offset of the start of the current line
+}
+
+func (p *positionReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	for i, c := range b[:n] {
+		if c == '\n' {
+			p.newlines = append(p.newlines, p.read+int64(i))
+		}
+	}
+	p.read += int64(n)
+	return n, err
+}
+
+// position returns the line and column of an offset. The offsets must not
+// decrease between calls.
+func (p *positionReader) position(offset int64) (int, int) {
+	i := 0
+	for i < len(p.newlines) && p.newlines[i] < offset {
+		p.start = p.newlines[i] + 1
+		i++
+	}
+	p.line += i
+	p.newlines = p.newlines[i:]
+	return p.line, int(offset-p.start) + 1
+}
+
+// positionDecoder is an xml decoder that knows the line and column of the
+// start of the token it returned last
+type positionDecoder struct {
+	*xml.Decoder
+	pr     *positionReader
+	Line   int
+	Column int
+}
+
+func newPositionDecoder(r io.Reader) *positionDecoder {
+	pr := &positionReader{r: r, line: 1}
+	return &positionDecoder{Decoder: xml.NewDecoder(pr), pr: pr}
+}
+
+func (d *positionDecoder) Token() (xml.Token, error) {
+	d.Line, d.Column = d.pr.position(d.InputOffset())
+	return d.Decoder.Token()
+}
+
+// errorAt adds the sav, the case and the position of the last token to an error
+func (d *positionDecoder) errorAt(err error, sav string, caseNr int32) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*PosError); ok {
+		return err
+	}
+	return &PosError{sav, caseNr, d.Line, d.Column, err}
+}
+
+// location describes where something happened in an xsav document, as a
+// prefix for messages. Unknown parts, which are empty or zero, are left out.
+func location(sav string, caseNr int32, line, column int) string {
+	var parts []string
+	if sav != "" {
+		parts = append(parts, "sav "+sav)
+	}
+	if caseNr > 0 {
+		parts = append(parts, fmt.Sprintf("case %d", caseNr))
+	}
+	if line > 0 {
+		parts = append(parts, fmt.Sprintf("line %d, column %d", line, column))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, ", ") + ": "
+}
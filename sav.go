@@ -17,12 +17,13 @@ GNU General Public License for more details.
 You should have received a copy of the GNU General Public License
 along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
 */
-package main
+package xml2sav
 
 import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"math"
@@ -31,17 +32,89 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const TimeOffset = 12219379200
 
+// DefaultMaxStringLength is the default maximum width of string variables
+const DefaultMaxStringLength = 1024 * 50
+
+// maxPrintStringWidth is the maximum display width of string variables
+const maxPrintStringWidth = 40
+
 const SPSS_NUMERIC = 0
 
 const (
 	SPSS_FMT_A         = 1
+	SPSS_FMT_COMMA     = 3
+	SPSS_FMT_DOLLAR    = 4
 	SPSS_FMT_F         = 5
+	SPSS_FMT_N         = 16
+	SPSS_FMT_E         = 17
 	SPSS_FMT_DATE      = 20
+	SPSS_FMT_TIME      = 21
 	SPSS_FMT_DATE_TIME = 22
+	SPSS_FMT_ADATE     = 23
+	SPSS_FMT_JDATE     = 24
+	SPSS_FMT_DTIME     = 25
+	SPSS_FMT_WKDAY     = 26
+	SPSS_FMT_MONTH     = 27
+	SPSS_FMT_MOYR      = 28
+	SPSS_FMT_QYR       = 29
+	SPSS_FMT_WKYR      = 30
+	SPSS_FMT_PCT       = 31
+	SPSS_FMT_EDATE     = 38
+	SPSS_FMT_SDATE     = 39
+	SPSS_FMT_YMDHMS    = 41
+)
+
+type formatInfo struct {
+	name        string // name as used in SPSS syntax
+	minWidth    byte
+	maxDecimals byte
+	date        bool // shows a date, only for date and datetime variables
+}
+
+var formats = map[byte]formatInfo{
+	SPSS_FMT_A:         {"A", 1, 0, false},
+	SPSS_FMT_COMMA:     {"COMMA", 1, 16, false},
+	SPSS_FMT_DOLLAR:    {"DOLLAR", 2, 16, false},
+	SPSS_FMT_F:         {"F", 1, 16, false},
+	SPSS_FMT_N:         {"N", 1, 16, false},
+	SPSS_FMT_E:         {"E", 6, 16, false},
+	SPSS_FMT_DATE:      {"DATE", 9, 0, true},
+	SPSS_FMT_TIME:      {"TIME", 5, 16, false},
+	SPSS_FMT_DATE_TIME: {"DATETIME", 17, 16, true},
+	SPSS_FMT_ADATE:     {"ADATE", 8, 0, true},
+	SPSS_FMT_JDATE:     {"JDATE", 5, 0, true},
+	SPSS_FMT_DTIME:     {"DTIME", 8, 16, false},
+	SPSS_FMT_WKDAY:     {"WKDAY", 2, 0, false},
+	SPSS_FMT_MONTH:     {"MONTH", 3, 0, false},
+	SPSS_FMT_MOYR:      {"MOYR", 6, 0, true},
+	SPSS_FMT_QYR:       {"QYR", 6, 0, true},
+	SPSS_FMT_WKYR:      {"WKYR", 8, 0, true},
+	SPSS_FMT_PCT:       {"PCT", 2, 16, false},
+	SPSS_FMT_EDATE:     {"EDATE", 8, 0, true},
+	SPSS_FMT_SDATE:     {"SDATE", 8, 0, true},
+	SPSS_FMT_YMDHMS:    {"YMDHMS", 16, 16, true},
+}
+
+// Kinds of variables, they determine how the values of a case are parsed
+const (
+	KindNumeric = iota
+	KindString
+	KindDate
+	KindDateTime
+	KindTime
+	KindDuration
+	KindBoolean
+)
+
+const (
+	SPSS_COMPRESS_NONE     = 0
+	SPSS_COMPRESS_BYTECODE = 1
+	SPSS_COMPRESS_ZLIB     = 2
 )
 
 const (
@@ -50,27 +123,65 @@ const (
 	SPSS_MLVL_RAT = 3
 )
 
+const (
+	SPSS_ROLE_INPUT     = 0
+	SPSS_ROLE_TARGET    = 1
+	SPSS_ROLE_BOTH      = 2
+	SPSS_ROLE_NONE      = 3
+	SPSS_ROLE_PARTITION = 4
+	SPSS_ROLE_SPLIT     = 5
+)
+
+// Attribute is a custom attribute. Attributes with the same name form an array.
+type Attribute struct {
+	Name  string
+	Value string
+}
+
 type Label struct {
 	Value string
 	Desc  string
+	Lang  string // language of the label, empty for the default label
+}
+
+// Translation is a variable label in another language
+type Translation struct {
+	Lang string
+	Text string
 }
 
 type Var struct {
-	Index      int32
-	Name       string
-	ShortName  string
-	Type       int32
-	Print      byte
-	Width      byte
-	Decimals   byte
-	Measure    int32
-	Label      string
-	Default    string
-	HasDefault bool
-	Labels     []Label
-	Value      string
-	HasValue   bool
-	Segments   int // how many segments
+	Index           int32
+	Name            string
+	ShortName       string
+	Type            int32
+	Kind            int
+	DateFormat      string         // how to parse date and datetime values, see parseDate
+	TimeZone        *time.Location // zone to convert date and datetime values to, UTC when nil
+	Locale          string         // locale of the month names in date and datetime values
+	NumberFormat    *NumberFormat  // how to parse numeric values, the format of the writer when nil
+	Print           byte
+	Width           byte
+	Decimals        byte
+	Measure         int32
+	Label           string
+	Translations    []Translation // variable label in other languages
+	Default         string
+	HasDefault      bool
+	Labels          []Label
+	LabelSet        string   // variables with the same label set share their value labels
+	Missing         []string // discrete user-missing values
+	MissingLow      string   // low end of the missing range
+	MissingHigh     string   // high end of the missing range
+	HasMissingRange bool
+	Role            int32
+	Attributes      []Attribute
+	Value           string
+	HasValue        bool
+	Segments        int // how many segments
+	Rejected        int // number of values that could not be parsed
+	Line            int // position in the xml of the value, or of the declaration before the cases
+	Column          int
 }
 
 // SegmentWidth returns the width of the given segment
@@ -84,28 +195,129 @@ func (v *Var) SegmentWidth(index int) int32 {
 	return v.Type - int32(v.Segments-1)*252
 }
 
+// langRank returns the position of lang in the preferred languages. Labels
+// without a language come after the preferred languages, other languages last.
+func langRank(lang string, langs []string) int {
+	for i, l := range langs {
+		if strings.EqualFold(l, lang) {
+			return i
+		}
+	}
+	if lang == "" {
+		return len(langs)
+	}
+	return len(langs) + 1
+}
+
+// label returns the variable label in the first of the preferred languages that
+// it has, else the default label, else its first translation
+func (v *Var) label(langs []string) string {
+	label, rank := v.Label, langRank("", langs)
+	if label == "" {
+		rank = len(langs) + 2
+	}
+	for _, t := range v.Translations {
+		if r := langRank(t.Lang, langs); r < rank {
+			label, rank = t.Text, r
+		}
+	}
+	return label
+}
+
+// valueLabels returns one label per value, in the first of the preferred
+// languages that it has, else the default label, else the first label
+func (v *Var) valueLabels(langs []string) []Label {
+	var labels []Label
+	ranks := make(map[string]int)
+	for _, l := range v.Labels {
+		r := langRank(l.Lang, langs)
+		if cur, found := ranks[l.Value]; !found {
+			ranks[l.Value] = r
+			labels = append(labels, l)
+		} else if r < cur {
+			ranks[l.Value] = r
+			for i := range labels {
+				if labels[i].Value == l.Value {
+					labels[i] = l
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// missingCount returns the n_missing_values field of the variable record.
+// Strings longer than 8 bytes store their missing values in a separate record.
+func (v *Var) missingCount() int32 {
+	if v.Type > 8 {
+		return 0
+	}
+	if v.HasMissingRange {
+		return -2 - int32(len(v.Missing))
+	}
+	return int32(len(v.Missing))
+}
+
+// MRSet is a multiple response set. A multiple dichotomy set counts the member
+// variables that have the counted value, a multiple category set treats the
+// values of all members as one set of categories.
+type MRSet struct {
+	Name          string // Set name, always starting with a $
+	Label         string
+	Dichotomy     bool   // Multiple dichotomy instead of multiple category set
+	CountedValue  string // Counted value of a dichotomy set
+	CountedLabels bool   // Use the counted value labels as category labels
+	Vars          []*Var
+}
+
 var endian = binary.LittleEndian
 
+// caseWriter writes the elements of the cases, it is implemented by
+// BytecodeWriter for compressed and RawWriter for uncompressed files
+type caseWriter interface {
+	WriteMissing() error
+	WriteNumber(number float64) error
+	WriteString(val string, elements int) error
+	Flush() error
+}
+
 type SpssWriter struct {
-	*bufio.Writer                 // Buffered writer
-	seeker        io.WriteSeeker  // Original writer
-	bytecode      *BytecodeWriter // Special writer for compressed cases
-	Dict          []*Var          // Variables
-	DictMap       map[string]*Var // Long variable names index
-	ShortMap      map[string]*Var // Short variable names index
-	Count         int32           // Number of cases
-	Index         int32
+	*bufio.Writer                    // Buffered writer
+	seeker           io.WriteSeeker  // Original writer
+	cases            caseWriter      // Special writer for (compressed) cases
+	zlib             *ZlibWriter     // Block compression of the bytecode for ZSAV files
+	Dict             []*Var          // Variables
+	DictMap          map[string]*Var // Long variable names index
+	ShortMap         map[string]*Var // Short variable names index
+	Count            int32           // Number of cases
+	Index            int32
+	Weight           *Var          // Case weight variable, nil when unweighted
+	MRSets           []*MRSet      // Multiple response sets
+	Attributes       []Attribute   // Datafile attributes
+	Documents        []string      // Document lines, wrapped when written
+	Compression      int32         // SPSS_COMPRESS_*, set before Start
+	NumberFormat     *NumberFormat // Default format of numeric values, plain numbers when nil
+	Languages        []string      // Preferred languages of the labels, in order
+	MaxStringLength  int           // Maximum width of string variables
+	IgnoreMissingVar bool          // Ignore values of variables that are not in the dictionary, unless Strict
+	Name             string        // Name of the sav in the xsav document, used in messages
+	Strict           bool          // Fail on every problem in the input
+	MaxErrors        int           // Number of problems in the input to tolerate, 0 for the default
+	Problems         int           // Number of problems in the input that were tolerated
 }
 
 func NewSpssWriter(w io.WriteSeeker) *SpssWriter {
 	out := &SpssWriter{
-		seeker:   w,
-		Writer:   bufio.NewWriter(w),
-		DictMap:  make(map[string]*Var),
-		ShortMap: make(map[string]*Var),
-		Index:    1,
+		seeker:      w,
+		Writer:      bufio.NewWriter(w),
+		DictMap:     make(map[string]*Var),
+		ShortMap:    make(map[string]*Var),
+		Index:       1,
+		Compression: SPSS_COMPRESS_BYTECODE,
+
+		MaxStringLength: DefaultMaxStringLength,
 	}
-	out.bytecode = NewBytecodeWriter(out.Writer, 100.0)
+	out.cases = NewBytecodeWriter(out.Writer, 100.0)
 	return out
 }
 
@@ -138,12 +350,13 @@ func ftoa(f float64) string {
 	return strconv.FormatFloat(f, 'E', -1, 64)
 }
 
-func atof(s string) float64 {
-	v, err := strconv.ParseFloat(s, 32)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return v
+// formatNumber formats a number without loss of precision
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func atof(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(s), 64)
 }
 
 func elementCount(width int32) int32 {
@@ -166,6 +379,60 @@ func cleanVarName(n string) string {
 	return n
 }
 
+var formatRegExp = regexp.MustCompile(`^([A-Za-z]+)(\d+)(?:\.(\d+))?$`)
+
+// ParseFormat parses a print format like F8.2, COMMA10 or ADATE10 and checks it
+// can be used for variables of the given kind
+func ParseFormat(spec string, kind int) (print, width, decimals byte, err error) {
+	parts := formatRegExp.FindStringSubmatch(spec)
+	if parts == nil {
+		return 0, 0, 0, fmt.Errorf("Invalid format %s", spec)
+	}
+	name := strings.ToUpper(parts[1])
+	var info formatInfo
+	for p, i := range formats {
+		if i.name == name {
+			print, info = p, i
+		}
+	}
+	if print == 0 {
+		return 0, 0, 0, fmt.Errorf("Unknown format %s", spec)
+	}
+	switch {
+	case kind == KindString || print == SPSS_FMT_A:
+		return 0, 0, 0, fmt.Errorf("Format %s can not be used for string variables", spec)
+	case (kind == KindDate || kind == KindDateTime) != info.date:
+		return 0, 0, 0, fmt.Errorf("Format %s does not match the type of the variable", spec)
+	case (kind == KindTime || kind == KindDuration) && print != SPSS_FMT_TIME && print != SPSS_FMT_DTIME:
+		return 0, 0, 0, fmt.Errorf("Format %s does not match the type of the variable", spec)
+	}
+
+	w, _ := strconv.Atoi(parts[2])
+	d := 0
+	if parts[3] != "" {
+		d, _ = strconv.Atoi(parts[3])
+	}
+	if w < int(info.minWidth) || w > 40 {
+		return 0, 0, 0, fmt.Errorf("Width of format %s must be between %d and 40", spec, info.minWidth)
+	}
+	if d > int(info.maxDecimals) || (d > 0 && d >= w) {
+		return 0, 0, 0, fmt.Errorf("Too many decimals for format %s", spec)
+	}
+	return print, byte(w), byte(d), nil
+}
+
+// FormatSpec returns a print format the way SPSS shows it, like F8.2 or A20
+func FormatSpec(print, width, decimals byte) string {
+	name := fmt.Sprintf("format%d_", print)
+	if info, found := formats[print]; found {
+		name = info.name
+	}
+	if decimals > 0 {
+		return fmt.Sprintf("%s%d.%d", name, width, decimals)
+	}
+	return fmt.Sprintf("%s%d", name, width)
+}
+
 func (out *SpssWriter) caseSize() int32 {
 	size := int32(0)
 	for _, v := range out.Dict {
@@ -200,7 +467,7 @@ func (out *SpssWriter) writeString(v *Var, val string) error {
 			val = ""
 		}
 
-		if err := out.bytecode.WriteString(p, int(elementCount(v.SegmentWidth(s)))); err != nil {
+		if err := out.cases.WriteString(p, int(elementCount(v.SegmentWidth(s)))); err != nil {
 			return err
 		}
 	}
@@ -208,14 +475,25 @@ func (out *SpssWriter) writeString(v *Var, val string) error {
 	return nil
 }
 
+func (out *SpssWriter) weightIndex() int32 {
+	if out.Weight == nil {
+		return 0
+	}
+	return out.Weight.Index
+}
+
 func (out *SpssWriter) headerRecord(fileLabel string) {
 	c := time.Now()
-	out.Write(stob("$FL2", 4))                               // rec_tyoe
+	if out.Compression == SPSS_COMPRESS_ZLIB {
+		out.Write(stob("$FL3", 4)) // rec_tyoe
+	} else {
+		out.Write(stob("$FL2", 4)) // rec_tyoe
+	}
 	out.Write(stob("@(#) SPSS DATA FILE - xml2sav 2.0", 60)) // prod_name
 	binary.Write(out, endian, int32(2))                      // layout_code
 	binary.Write(out, endian, out.caseSize())                // nominal_case_size
-	binary.Write(out, endian, int32(1))                      // compression
-	binary.Write(out, endian, int32(0))                      // weight_index
+	binary.Write(out, endian, out.Compression)               // compression
+	binary.Write(out, endian, out.weightIndex())             // weight_index
 	binary.Write(out, endian, int32(-1))                     // ncases
 	binary.Write(out, endian, float64(100))                  // bias
 	out.Write(stob(c.Format("02 Jan 06"), 9))                // creation_date
@@ -226,11 +504,48 @@ func (out *SpssWriter) headerRecord(fileLabel string) {
 
 // If you use a buffer, supply it as the flusher argument
 // After this close the file
-func (out *SpssWriter) updateHeaderNCases() {
-	out.bytecode.Flush()
-	out.Flush()
-	out.Seek(80, 0)
-	binary.Write(out.seeker, endian, out.Count) // ncases in headerRecord
+func (out *SpssWriter) updateHeaderNCases() error {
+	if err := out.cases.Flush(); err != nil {
+		return err
+	}
+	if out.zlib != nil {
+		if err := out.zlib.Close(); err != nil {
+			return err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if _, err := out.Seek(80, 0); err != nil {
+		return err
+	}
+	return binary.Write(out.seeker, endian, out.Count) // ncases in headerRecord
+}
+
+// startZlib writes the zheader after the flushed dictionary and routes the
+// bytecode through the block compression
+func (out *SpssWriter) startZlib() error {
+	offset, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	out.zlib = NewZlibWriter(out.Writer, offset, 100.0)
+	if err = out.zlib.WriteHeader(); err != nil {
+		return err
+	}
+	out.cases = NewBytecodeWriter(out.zlib, 100.0)
+	return nil
+}
+
+// updateZHeader fills in the location of the ztrailer in the zheader
+func (out *SpssWriter) updateZHeader() error {
+	if _, err := out.Seek(out.zlib.headerOffset+8, 0); err != nil {
+		return err
+	}
+	if err := binary.Write(out.seeker, endian, out.zlib.trailerOffset); err != nil { // ztrailer_ofs
+		return err
+	}
+	return binary.Write(out.seeker, endian, out.zlib.trailerLength) // ztrailer_len
 }
 
 func (out *SpssWriter) variableRecords() {
@@ -239,12 +554,17 @@ func (out *SpssWriter) variableRecords() {
 			width := v.SegmentWidth(segment)
 			binary.Write(out, endian, int32(2)) // rec_type
 			binary.Write(out, endian, width)    // type (0 or strlen)
-			if segment == 0 && len(v.Label) > 0 {
+			label := v.label(out.Languages)
+			if segment == 0 && len(label) > 0 {
 				binary.Write(out, endian, int32(1)) // has_var_label
 			} else {
 				binary.Write(out, endian, int32(0)) // has_var_label
 			}
-			binary.Write(out, endian, int32(0)) // n_missing_values
+			if segment == 0 {
+				binary.Write(out, endian, v.missingCount()) // n_missing_values
+			} else {
+				binary.Write(out, endian, int32(0)) // n_missing_values
+			}
 			var format int32
 			if v.Type > 0 { // string
 				format = int32(v.Print)<<16 | int32(width)<<8
@@ -256,10 +576,10 @@ func (out *SpssWriter) variableRecords() {
 			if segment == 0 {                 // first var
 				v.ShortName = out.makeShortName(v)
 				out.Write(stob(v.ShortName, 8)) // name
-				if len(v.Label) > 0 {
-					binary.Write(out, endian, int32(len(v.Label))) // label_len
-					out.Write([]byte(v.Label))                     // label
-					pad := (4 - len(v.Label)) % 4
+				if len(label) > 0 {
+					binary.Write(out, endian, int32(len(label))) // label_len
+					out.Write([]byte(label))                     // label
+					pad := (4 - len(label)) % 4
 					if pad < 0 {
 						pad += 4
 					}
@@ -267,6 +587,7 @@ func (out *SpssWriter) variableRecords() {
 						out.Write([]byte{0}) // pad out until multiple of 32 bit
 					}
 				}
+				out.missingValues(v)
 			} else { // segment > 0
 				out.Write(stob(out.makeShortName(v), 8)) // name (a fresh new one)
 			}
@@ -287,14 +608,48 @@ func (out *SpssWriter) variableRecords() {
 	}
 }
 
+// missingValues writes the missing values of a numeric or short string variable
+func (out *SpssWriter) missingValues(v *Var) {
+	if v.missingCount() == 0 {
+		return
+	}
+	if v.HasMissingRange {
+		low, _ := strconv.ParseFloat(v.MissingLow, 64)
+		high, _ := strconv.ParseFloat(v.MissingHigh, 64)
+		binary.Write(out, endian, low)  // low
+		binary.Write(out, endian, high) // high
+	}
+	for _, m := range v.Missing {
+		if v.Type == 0 {
+			f, _ := strconv.ParseFloat(m, 64)
+			binary.Write(out, endian, f) // value
+		} else {
+			out.Write(stob(m, 8)) // value
+		}
+	}
+}
+
 func (out *SpssWriter) valueLabelRecords() {
-	for _, v := range out.Dict {
-		if len(v.Labels) > 0 && v.Type <= 8 {
-			binary.Write(out, endian, int32(3))             // rec_type
-			binary.Write(out, endian, int32(len(v.Labels))) // label_count
-			for _, label := range v.Labels {
+	shared := make(map[*Var]bool)
+	for i, v := range out.Dict {
+		if len(v.Labels) > 0 && v.Type <= 8 && !shared[v] {
+			vars := []*Var{v}
+			if v.LabelSet != "" {
+				for _, w := range out.Dict[i+1:] {
+					if w.LabelSet == v.LabelSet && w.Type <= 8 && (w.Type == 0) == (v.Type == 0) {
+						vars = append(vars, w)
+						shared[w] = true
+					}
+				}
+			}
+
+			labels := v.valueLabels(out.Languages)
+			binary.Write(out, endian, int32(3))           // rec_type
+			binary.Write(out, endian, int32(len(labels))) // label_count
+			for _, label := range labels {
 				if v.Type == 0 {
-					binary.Write(out, endian, atof(label.Value)) // value
+					f, _ := atof(label.Value)    // checked by AddVar
+					binary.Write(out, endian, f) // value
 				} else {
 					binary.Write(out, endian, stob(label.Value, 8)) // value
 				}
@@ -313,13 +668,51 @@ func (out *SpssWriter) valueLabelRecords() {
 				}
 			}
 
-			binary.Write(out, endian, int32(4))       // rec_type
-			binary.Write(out, endian, int32(1))       // var_count
-			binary.Write(out, endian, int32(v.Index)) // vars
+			binary.Write(out, endian, int32(4))         // rec_type
+			binary.Write(out, endian, int32(len(vars))) // var_count
+			for _, w := range vars {
+				binary.Write(out, endian, int32(w.Index)) // vars
+			}
 		}
 	}
 }
 
+// wrapLine splits a line into parts of at most width bytes, preferably at a space
+func wrapLine(line string, width int) []string {
+	var lines []string
+	for len(line) > width {
+		i := strings.LastIndexByte(line[:width+1], ' ')
+		if i <= 0 {
+			i = width
+			for i > 0 && !utf8.RuneStart(line[i]) {
+				i--
+			}
+			if i == 0 {
+				i = width
+			}
+		}
+		lines = append(lines, strings.TrimRight(line[:i], " "))
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	return append(lines, line)
+}
+
+func (out *SpssWriter) documentRecord() {
+	var lines []string
+	for _, d := range out.Documents {
+		lines = append(lines, wrapLine(d, 80)...)
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	binary.Write(out, endian, int32(6))          // rec_type
+	binary.Write(out, endian, int32(len(lines))) // n_lines
+	for _, l := range lines {
+		out.Write(stob(l, 80)) // line
+	}
+}
+
 func (out *SpssWriter) machineIntegerInfoRecord() {
 	binary.Write(out, endian, int32(7))     // rec_type
 	binary.Write(out, endian, int32(3))     // subtype
@@ -345,6 +738,47 @@ func (out *SpssWriter) machineFloatingPointInfoRecord() {
 	binary.Write(out, endian, float64(-math.MaxFloat64)) // lowest
 }
 
+// multipleResponseSetsRecord writes the subtype 7 record with the sets that
+// older versions understand, or with extended true the subtype 19 record with
+// dichotomy sets that use the counted value labels.
+func (out *SpssWriter) multipleResponseSetsRecord(extended bool) {
+	buf := bytes.Buffer{}
+	for _, m := range out.MRSets {
+		if m.CountedLabels != extended {
+			continue
+		}
+		buf.WriteString(m.Name + "=")
+		if m.Dichotomy {
+			if m.CountedLabels {
+				buf.WriteString("E 1 ")
+			} else {
+				buf.WriteString("D")
+			}
+			buf.WriteString(strconv.Itoa(len(m.CountedValue)) + " " + m.CountedValue)
+		} else {
+			buf.WriteString("C")
+		}
+		buf.WriteString(" " + strconv.Itoa(len(m.Label)) + " " + m.Label)
+		for _, v := range m.Vars {
+			buf.WriteString(" " + strings.ToLower(v.ShortName))
+		}
+		buf.WriteByte('\n')
+	}
+	if buf.Len() == 0 {
+		return
+	}
+
+	subtype := int32(7)
+	if extended {
+		subtype = 19
+	}
+	binary.Write(out, endian, int32(7))         // rec_type
+	binary.Write(out, endian, subtype)          // subtype
+	binary.Write(out, endian, int32(1))         // size
+	binary.Write(out, endian, int32(buf.Len())) // count
+	out.Write(buf.Bytes())
+}
+
 func (out *SpssWriter) variableDisplayParameterRecord() {
 	binary.Write(out, endian, int32(7))         // rec_type
 	binary.Write(out, endian, int32(11))        // subtype
@@ -419,6 +853,64 @@ func (out *SpssWriter) veryLongStringRecord() {
 	out.Write(buf.Bytes())
 }
 
+// attributeQuoter quotes the value of an attribute. A value ends at a quote
+// followed by a newline, so quotes are doubled and line breaks become spaces.
+var attributeQuoter = strings.NewReplacer("'", "''", "\r\n", " ", "\n", " ", "\r", " ")
+
+// writeAttributes writes a set of attributes as name('value'\n'value'\n)
+func writeAttributes(buf *bytes.Buffer, attributes []Attribute) {
+	done := make(map[string]bool)
+	for i, a := range attributes {
+		if done[a.Name] {
+			continue
+		}
+		done[a.Name] = true
+		buf.WriteString(a.Name + "(")
+		for _, b := range attributes[i:] {
+			if b.Name == a.Name {
+				buf.WriteString("'" + attributeQuoter.Replace(b.Value) + "'\n")
+			}
+		}
+		buf.WriteString(")")
+	}
+}
+
+func (out *SpssWriter) dataFileAttributesRecord() {
+	if len(out.Attributes) == 0 {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	writeAttributes(&buf, out.Attributes)
+
+	binary.Write(out, endian, int32(7))         // rec_type
+	binary.Write(out, endian, int32(17))        // subtype
+	binary.Write(out, endian, int32(1))         // size
+	binary.Write(out, endian, int32(buf.Len())) // count
+	out.Write(buf.Bytes())
+}
+
+func (out *SpssWriter) variableAttributesRecord() {
+	if len(out.Dict) == 0 {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	for i, v := range out.Dict {
+		if i > 0 {
+			buf.WriteString("/")
+		}
+		buf.WriteString(v.Name + ":")
+		writeAttributes(&buf, append([]Attribute{{"$@Role", strconv.Itoa(int(v.Role))}}, v.Attributes...))
+	}
+
+	binary.Write(out, endian, int32(7))         // rec_type
+	binary.Write(out, endian, int32(18))        // subtype
+	binary.Write(out, endian, int32(1))         // size
+	binary.Write(out, endian, int32(buf.Len())) // count
+	out.Write(buf.Bytes())
+}
+
 func (out *SpssWriter) encodingRecord() {
 	binary.Write(out, endian, int32(7))  // rec_type
 	binary.Write(out, endian, int32(20)) // subtype
@@ -444,11 +936,12 @@ func (out *SpssWriter) longStringValueLabelsRecord() {
 	buf := new(bytes.Buffer)
 	for _, v := range out.Dict {
 		if len(v.Labels) > 0 && v.Type > 8 {
+			labels := v.valueLabels(out.Languages)
 			binary.Write(buf, endian, int32(len(v.ShortName))) // var_name_len
 			buf.Write([]byte(v.ShortName))                     // var_name
 			binary.Write(buf, endian, v.Type)                  // var_width
-			binary.Write(buf, endian, int32(len(v.Labels)))    // n_labels
-			for _, l := range v.Labels {
+			binary.Write(buf, endian, int32(len(labels)))      // n_labels
+			for _, l := range labels {
 				binary.Write(buf, endian, int32(len(l.Value))) // value_len
 				buf.Write([]byte(l.Value))                     // value
 				binary.Write(buf, endian, int32(len(l.Desc)))  // label_len
@@ -464,6 +957,30 @@ func (out *SpssWriter) longStringValueLabelsRecord() {
 	out.Write(buf.Bytes())
 }
 
+func (out *SpssWriter) longStringMissingValuesRecord() {
+	buf := new(bytes.Buffer)
+	for _, v := range out.Dict {
+		if len(v.Missing) > 0 && v.Type > 8 {
+			binary.Write(buf, endian, int32(len(v.ShortName))) // var_name_len
+			buf.Write([]byte(v.ShortName))                     // var_name
+			buf.WriteByte(byte(len(v.Missing)))                // n_missing_values
+			binary.Write(buf, endian, int32(8))                // value_len
+			for _, m := range v.Missing {
+				buf.Write(stob(m, 8)) // value
+			}
+		}
+	}
+	if buf.Len() == 0 {
+		return
+	}
+
+	binary.Write(out, endian, int32(7))         // rec_type
+	binary.Write(out, endian, int32(22))        // subtype
+	binary.Write(out, endian, int32(1))         // size
+	binary.Write(out, endian, int32(buf.Len())) // count
+	out.Write(buf.Bytes())
+}
+
 func (out *SpssWriter) terminationRecord() {
 	binary.Write(out, endian, int32(999)) // rec_type
 	binary.Write(out, endian, int32(0))   // filler
@@ -507,21 +1024,34 @@ func (out *SpssWriter) makeShortName(v *Var) string {
 	return short
 }
 
-func (out *SpssWriter) AddVar(v *Var) {
-	if v.Type > int32(maxStringLength) {
-		log.Fatalln("Maximum length for a variable is %d,", maxStringLength, v.Name, "is", v.Type)
+func (out *SpssWriter) AddVar(v *Var) error {
+	if v.Type > int32(out.MaxStringLength) {
+		return &WidthError{v.Name, int(v.Type), out.MaxStringLength}
+	}
+	if v.Type == SPSS_NUMERIC {
+		labels := v.Labels[:0]
+		for _, l := range v.Labels {
+			if _, err := atof(l.Value); err != nil {
+				if err = out.problem(&LabelValueError{v.Name, l.Value}, false, location(out.Name, 0, v.Line, v.Column), "label ignored"); err != nil {
+					return err
+				}
+				continue
+			}
+			labels = append(labels, l)
+		}
+		v.Labels = labels
 	}
 
 	// Clean variable name
 	origName := v.Name
 	name := cleanVarName(v.Name)
 	if name != v.Name {
-		log.Printf("Change variable name '%s' to '%s'\n", v.Name, name)
+		log.Printf("%sChange variable name '%s' to '%s'\n", location(out.Name, 0, v.Line, v.Column), v.Name, name)
 		v.Name = name
 	}
 
 	if _, found := out.DictMap[origName]; found {
-		log.Fatalln("Adding duplicate variable named", origName)
+		return &DuplicateVarError{origName}
 	}
 
 	v.Segments = 1
@@ -536,105 +1066,240 @@ func (out *SpssWriter) AddVar(v *Var) {
 
 	out.Dict = append(out.Dict, v)
 	out.DictMap[origName] = v
+	return nil
+}
+
+// SetWeight makes the named numeric variable the case weight of the file
+func (out *SpssWriter) SetWeight(name string) error {
+	v, found := out.DictMap[name]
+	if !found {
+		return fmt.Errorf("Weight variable %s is not declared in the dictionary", name)
+	}
+	if v.Type != SPSS_NUMERIC {
+		return fmt.Errorf("Weight variable %s must be numeric", name)
+	}
+	out.Weight = v
+	return nil
+}
+
+// AddMRSet adds a multiple response set with the named variables as members
+func (out *SpssWriter) AddMRSet(m *MRSet, members []string) error {
+	if !strings.HasPrefix(m.Name, "$") {
+		m.Name = "$" + m.Name
+	}
+	if m.Name != "$"+cleanVarName(m.Name[1:]) {
+		return fmt.Errorf("Multiple response set name %s is not a valid name", m.Name)
+	}
+	for _, s := range out.MRSets {
+		if strings.EqualFold(s.Name, m.Name) {
+			return fmt.Errorf("Adding duplicate multiple response set named %s", m.Name)
+		}
+	}
+	if len(members) < 2 {
+		return fmt.Errorf("Multiple response set %s needs at least two variables", m.Name)
+	}
+
+	m.Vars = nil
+	for _, name := range members {
+		v, found := out.DictMap[name]
+		if !found {
+			return fmt.Errorf("Multiple response set %s refers to undeclared variable %s", m.Name, name)
+		}
+		if len(m.Vars) > 0 && (v.Type == SPSS_NUMERIC) != (m.Vars[0].Type == SPSS_NUMERIC) {
+			return fmt.Errorf("Variables of multiple response set %s must be all numeric or all string", m.Name)
+		}
+		m.Vars = append(m.Vars, v)
+	}
+
+	if m.Dichotomy {
+		if m.Vars[0].Type == SPSS_NUMERIC {
+			f, err := strconv.ParseFloat(m.CountedValue, 64)
+			if err != nil {
+				return fmt.Errorf("Counted value '%s' of multiple response set %s is not a number", m.CountedValue, m.Name)
+			}
+			m.CountedValue = strconv.FormatFloat(f, 'f', -1, 64)
+		} else if m.CountedValue == "" {
+			return fmt.Errorf("Multiple response set %s needs a counted value", m.Name)
+		}
+	} else {
+		m.CountedValue = ""
+		m.CountedLabels = false
+	}
+
+	out.MRSets = append(out.MRSets, m)
+	return nil
 }
 
 func (out *SpssWriter) ClearCase() {
 	for _, v := range out.Dict {
 		v.Value = ""
 		v.HasValue = false
+		v.Line = 0
+		v.Column = 0
 	}
 }
 
-func (out *SpssWriter) SetVar(name, value string) {
+func (out *SpssWriter) SetVar(name, value string) error {
+	return out.SetVarAt(name, value, 0, 0)
+}
+
+// SetVarAt sets the value of a variable like SetVar, and remembers the position
+// of the value in the xml for the messages about it
+func (out *SpssWriter) SetVarAt(name, value string, line, column int) error {
 	v, found := out.DictMap[name]
 	if !found {
-		if ignoreMissingVar {
-			return
+		if out.IgnoreMissingVar && !out.Strict {
+			return nil
 		}
-		log.Fatalln("Can not find the variable named in dictionary", name)
+		return out.problem(&UnknownVarError{name}, false, location(out.Name, out.Count+1, line, column), "value ignored")
 	}
 	v.Value = value
 	v.HasValue = true
+	v.Line = line
+	v.Column = column
+	return nil
 }
 
-func (out *SpssWriter) WriteCase() {
-	for _, v := range out.Dict {
-		if v.HasValue || v.HasDefault {
-			var val string
-			if v.HasValue {
-				val = v.Value
-			} else {
-				val = v.Default
-			}
+// problem handles a problem in the input, described by err and found at where.
+// When the problem is tolerated it is logged with what was done about it and
+// counted, and nil is returned. Otherwise it is returned as an error. Strict
+// tolerates nothing, MaxErrors tolerates that many problems of any kind, and
+// by default only the problems in values are tolerated.
+func (out *SpssWriter) problem(err error, inValue bool, where, done string) error {
+	if out.Strict || (out.MaxErrors == 0 && !inValue) {
+		return err
+	}
+	if out.MaxErrors > 0 && out.Problems >= out.MaxErrors {
+		return &MaxErrorsError{out.MaxErrors, err}
+	}
+	out.Problems++
+	log.Printf("%s%s - %s\n", where, err, done)
+	return nil
+}
 
-			if v.Type > 0 { // string
-				if len(val) > int(v.Type) {
-					val = val[:v.Type]
-					log.Printf("Truncated string for %s: %s\n", v.Name, val)
-				}
-				out.writeString(v, val)
-			} else if v.Print == SPSS_FMT_DATE {
-				if val == "" {
-					binary.Write(out, endian, -math.MaxFloat64) // Write missing
-				} else {
-					t, err := time.Parse("2-Jan-2006", v.Value)
-					if err != nil {
-						log.Printf("Problem pasing value for %s: %s - set as missing\n", v.Name, err)
-						out.bytecode.WriteMissing()
-					} else {
-						out.bytecode.WriteNumber(float64(t.Unix() + TimeOffset))
-					}
-				}
-			} else if v.Print == SPSS_FMT_DATE_TIME {
-				if val == "" {
-					out.bytecode.WriteMissing()
-				} else {
-					t, err := time.Parse("2-Jan-2006 15:04:05", v.Value)
-					if err != nil {
-						log.Printf("Problem pasing value for %s: %s - set as missing\n", v.Name, err)
-						out.bytecode.WriteMissing()
-					} else {
-						out.bytecode.WriteNumber(float64(t.Unix() + TimeOffset))
-					}
-				}
-			} else { // number
-				if val == "" {
-					out.bytecode.WriteMissing()
-				} else {
-					f, err := strconv.ParseFloat(val, 64)
-					if err != nil {
-						log.Printf("Problem pasing value for %s: %s - set as missing\n", v.Name, err)
-						out.bytecode.WriteMissing()
-					} else {
-						out.bytecode.WriteNumber(f)
-					}
-				}
-			}
-		} else { // Write missing value
-			if v.Type > 0 {
-				out.writeString(v, "")
-			} else {
-				out.bytecode.WriteMissing()
+// where returns the location of the value of a variable in the current case,
+// as a prefix for messages
+func (out *SpssWriter) where(v *Var) string {
+	return location(out.Name, out.Count+1, v.Line, v.Column)
+}
+
+// reject handles a value of a variable that can not be parsed. When the problem
+// is tolerated the value is written as missing.
+func (out *SpssWriter) reject(v *Var, val string, err error) error {
+	if err = out.problem(&ValueError{v.Name, val, err}, true, out.where(v), "set as missing"); err != nil {
+		return &PosError{out.Name, out.Count + 1, v.Line, v.Column, err}
+	}
+	v.Rejected++
+	return out.cases.WriteMissing()
+}
+
+// writeValue writes the value of a variable in the current case, its default
+// when it has no value, or else missing
+func (out *SpssWriter) writeValue(v *Var) error {
+	if !v.HasValue && !v.HasDefault { // Write missing value
+		if v.Type > 0 {
+			return out.writeString(v, "")
+		}
+		return out.cases.WriteMissing()
+	}
+	val := v.Default
+	if v.HasValue {
+		val = v.Value
+	}
+
+	if v.Type > 0 { // string
+		if len(val) > int(v.Type) {
+			err := out.problem(&TruncateError{v.Name, val, int(v.Type)}, true, out.where(v), "truncated to "+val[:v.Type])
+			if err != nil {
+				return &PosError{out.Name, out.Count + 1, v.Line, v.Column, err}
 			}
+			val = val[:v.Type]
+		}
+		return out.writeString(v, val)
+	}
+	if val == "" {
+		return out.cases.WriteMissing()
+	}
+
+	var f float64
+	var err error
+	switch v.Kind {
+	case KindDate, KindDateTime:
+		var t time.Time
+		if t, err = parseDate(val, v.DateFormat, v.Kind, v.TimeZone, v.Locale); err == nil {
+			f = spssTime(t)
+		}
+	case KindTime:
+		f, err = parseTime(val)
+	case KindDuration:
+		f, err = parseDuration(val)
+	case KindBoolean:
+		f, err = parseBoolean(val)
+	default: // number
+		nf := v.NumberFormat
+		if nf == nil {
+			nf = out.NumberFormat
+		}
+		f, err = nf.Parse(val)
+	}
+	if err != nil {
+		return out.reject(v, val, err)
+	}
+	return out.cases.WriteNumber(f)
+}
+
+// WriteCase writes the values of the variables as the next case. It returns an
+// error for a problem in the values that is not tolerated or when writing
+// fails, after which the file can not be finished.
+func (out *SpssWriter) WriteCase() error {
+	for _, v := range out.Dict {
+		if err := out.writeValue(v); err != nil {
+			return err
 		}
 	}
 	out.Count++
+	return nil
 }
 
-func (out *SpssWriter) Start(fileLabel string) {
+// Start writes the dictionary. The buffered writer keeps the first error of
+// the dictionary records, which the flush at the end returns.
+func (out *SpssWriter) Start(fileLabel string) error {
 	out.headerRecord(fileLabel)
 	out.variableRecords()
 	out.valueLabelRecords()
+	out.documentRecord()
 	out.machineIntegerInfoRecord()
 	out.machineFloatingPointInfoRecord()
+	out.multipleResponseSetsRecord(false)
+	out.multipleResponseSetsRecord(true)
 	out.variableDisplayParameterRecord()
 	out.longVarNameRecords()
 	out.veryLongStringRecord()
+	out.dataFileAttributesRecord()
+	out.variableAttributesRecord()
 	out.encodingRecord()
 	out.longStringValueLabelsRecord()
+	out.longStringMissingValuesRecord()
 	out.terminationRecord()
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	switch out.Compression {
+	case SPSS_COMPRESS_NONE:
+		out.cases = NewRawWriter(out.Writer)
+	case SPSS_COMPRESS_ZLIB:
+		return out.startZlib()
+	}
+	return nil
 }
 
-func (out *SpssWriter) Finish() {
-	out.updateHeaderNCases()
+// Finish writes the remaining cases and completes the header
+func (out *SpssWriter) Finish() error {
+	if err := out.updateHeaderNCases(); err != nil {
+		return err
+	}
+	if out.zlib != nil {
+		return out.updateZHeader()
+	}
+	return nil
 }
@@ -0,0 +1,269 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// xsavEncoder writes the elements of an xsav document, remembering the first error
+type xsavEncoder struct {
+	*xml.Encoder
+	err error
+}
+
+// start writes a start element with the attributes given as name, value pairs
+func (e *xsavEncoder) start(name string, attrs ...string) {
+	t := xml.StartElement{Name: xml.Name{Local: name}}
+	for i := 0; i < len(attrs); i += 2 {
+		t.Attr = append(t.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	if e.err == nil {
+		e.err = e.EncodeToken(t)
+	}
+}
+
+func (e *xsavEncoder) end(name string) {
+	if e.err == nil {
+		e.err = e.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+	}
+}
+
+// element writes an element with text content
+func (e *xsavEncoder) element(name, text string, attrs ...string) {
+	e.start(name, attrs...)
+	if e.err == nil && text != "" {
+		e.err = e.EncodeToken(xml.CharData(text))
+	}
+	e.end(name)
+}
+
+func measureName(measure int32) string {
+	switch measure {
+	case SPSS_MLVL_ORD:
+		return "ordinal"
+	case SPSS_MLVL_RAT:
+		return "scale"
+	}
+	return "nominal"
+}
+
+var roleNames = []string{"input", "target", "both", "none", "partition", "split"}
+
+func (e *xsavEncoder) variable(v *Var, weight bool) {
+	var attrs []string
+	_, known := formats[v.Print]
+	switch {
+	case v.Type > 0:
+		attrs = append(attrs, "type", "string", "name", v.Name, "width", strconv.Itoa(int(v.Type)))
+	case v.Kind == KindDate:
+		attrs = append(attrs, "type", "date", "name", v.Name)
+		if v.Print != SPSS_FMT_DATE || v.Width != 11 {
+			attrs = append(attrs, "format", FormatSpec(v.Print, v.Width, v.Decimals))
+		}
+	case v.Kind == KindDateTime:
+		attrs = append(attrs, "type", "datetime", "name", v.Name)
+		if v.Print != SPSS_FMT_DATE_TIME || v.Width != 20 {
+			attrs = append(attrs, "format", FormatSpec(v.Print, v.Width, v.Decimals))
+		}
+	case v.Kind == KindTime:
+		attrs = append(attrs, "type", "time", "name", v.Name)
+		if v.Width != 8 || v.Decimals != 0 {
+			attrs = append(attrs, "format", FormatSpec(v.Print, v.Width, v.Decimals))
+		}
+	case v.Kind == KindDuration:
+		attrs = append(attrs, "type", "duration", "name", v.Name)
+		if v.Width != 11 || v.Decimals != 0 {
+			attrs = append(attrs, "format", FormatSpec(v.Print, v.Width, v.Decimals))
+		}
+	case v.Print != SPSS_FMT_F && known:
+		attrs = append(attrs, "type", "numeric", "name", v.Name, "format", FormatSpec(v.Print, v.Width, v.Decimals))
+	default:
+		attrs = append(attrs, "type", "numeric", "name", v.Name,
+			"width", strconv.Itoa(int(v.Width)), "decimals", strconv.Itoa(int(v.Decimals)))
+	}
+	attrs = append(attrs, "measure", measureName(v.Measure))
+	if v.Label != "" {
+		attrs = append(attrs, "label", v.Label)
+	}
+	if v.Role != SPSS_ROLE_INPUT && int(v.Role) < len(roleNames) {
+		attrs = append(attrs, "role", roleNames[v.Role])
+	}
+	if weight {
+		attrs = append(attrs, "weight", "true")
+	}
+
+	e.start("var", attrs...)
+	for _, l := range v.Labels {
+		e.element("label", l.Desc, "value", l.Value)
+	}
+	for _, a := range v.Attributes {
+		if !strings.HasPrefix(a.Name, "$@") {
+			e.element("attr", a.Value, "name", a.Name)
+		}
+	}
+	if v.HasMissingRange {
+		e.element("missing", "", "low", v.MissingLow, "high", v.MissingHigh)
+	}
+	for _, m := range v.Missing {
+		e.element("missing", "", "value", m)
+	}
+	e.end("var")
+}
+
+func (e *xsavEncoder) mrset(m *MRSet) {
+	attrs := []string{"name", m.Name}
+	if m.Label != "" {
+		attrs = append(attrs, "label", m.Label)
+	}
+	if m.Dichotomy {
+		attrs = append(attrs, "type", "dichotomy", "value", m.CountedValue)
+		if m.CountedLabels {
+			attrs = append(attrs, "categorylabels", "countedvalues")
+		}
+	} else {
+		attrs = append(attrs, "type", "category")
+	}
+
+	e.start("mrset", attrs...)
+	for _, v := range m.Vars {
+		e.element("member", "", "name", v.Name)
+	}
+	e.end("mrset")
+}
+
+// writeXSav writes the dictionary and all cases of a sav file as a sav element
+func writeXSav(w io.Writer, savname string, in *SpssReader) error {
+	e := &xsavEncoder{Encoder: xml.NewEncoder(w)}
+	e.Indent("", "  ")
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	e.start("spss")
+	e.start("sav", "name", savname)
+	for _, a := range in.Attributes {
+		e.element("attr", a.Value, "name", a.Name)
+	}
+	if len(in.Documents) > 0 {
+		e.element("documents", strings.Join(in.Documents, "\n"))
+	}
+	e.start("dict")
+	for _, m := range in.MRSets {
+		e.mrset(m)
+	}
+	for _, v := range in.Dict {
+		e.variable(v, v == in.Weight)
+	}
+	e.end("dict")
+
+	for e.err == nil {
+		err := in.ReadCase()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		e.start("case")
+		for _, v := range in.Dict {
+			if v.HasValue {
+				e.element("val", v.Value, "name", v.Name)
+			}
+		}
+		e.end("case")
+	}
+
+	e.end("sav")
+	e.end("spss")
+	if e.err == nil {
+		e.err = e.Flush()
+	}
+	return e.err
+}
+
+// writeDictFile writes the variables as a dict element, which can be edited and
+// used in an xsav file
+func writeDictFile(filename string, dict []*Var) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	e := &xsavEncoder{Encoder: xml.NewEncoder(w)}
+	e.Indent("", "  ")
+	e.start("dict")
+	for _, v := range dict {
+		e.variable(v, false)
+	}
+	e.end("dict")
+	if e.err == nil {
+		e.err = e.Flush()
+	}
+	if e.err == nil {
+		e.err = w.Flush()
+	}
+	return e.err
+}
+
+// ConvertSavToXSav converts a sav file to an xsav file with the same base name
+func ConvertSavToXSav(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := NewSpssReader(in)
+	if err != nil {
+		return err
+	}
+	if r.Encoding != "" && r.Encoding != "UTF-8" {
+		log.Printf("Character encoding is %s, strings are copied without conversion\n", r.Encoding)
+	}
+
+	basename := strings.TrimSuffix(filename, filepath.Ext(filename))
+	xsavfilename := basename + ".xsav"
+	log.Println("Writing", xsavfilename)
+	f, err := os.Create(xsavfilename)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err = writeXSav(w, filepath.Base(basename), r); err == nil {
+		err = w.Flush()
+	}
+	if err != nil { // an unfinished xsav file is removed
+		f.Close()
+		os.Remove(xsavfilename)
+		return err
+	}
+	return f.Close()
+}
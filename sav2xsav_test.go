@@ -0,0 +1,142 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const roundTripXSav = `<?xml version="1.0"?>
+<spss>
+  <sav name="s" weight="w">
+    <attr name="source">panel</attr>
+    <documents>
+      Wave 1
+    </documents>
+    <dict>
+      <mrset name="$fruit" label="Fruit" type="dichotomy" value="1">
+        <member name="apple"/>
+        <member name="pear"/>
+      </mrset>
+      <var name="id" type="numeric" decimals="0" label="Respondent">
+        <attr name="qid">Q1</attr>
+      </var>
+      <var name="w" type="numeric" decimals="3"/>
+      <var name="q1" type="numeric" decimals="0" measure="ordinal">
+        <label value="1">Never</label>
+        <label value="2">Always</label>
+        <attr name="scale">frequency</attr>
+        <missing value="-99"/>
+        <missing low="-9" high="-1"/>
+      </var>
+      <var name="name" type="string" width="12" label="Name">
+        <label value="ann">Ann</label>
+        <missing value="NA"/>
+      </var>
+      <var name="remark" type="string" width="300"/>
+      <var name="born" type="date"/>
+      <var name="seen" type="datetime"/>
+      <var name="apple" type="numeric" decimals="0"/>
+      <var name="pear" type="numeric" decimals="0"/>
+    </dict>
+    <case>
+      <val name="id">1</val>
+      <val name="w">1.5</val>
+      <val name="q1">2</val>
+      <val name="name">ann</val>
+      <val name="remark">a remark that is quite long</val>
+      <val name="born">5-Mar-2009</val>
+      <val name="seen">5-Mar-2009 13:13:37.25</val>
+      <val name="apple">1</val>
+      <val name="pear">0</val>
+    </case>
+    <case>
+      <val name="id">2</val>
+      <val name="q1">-99</val>
+    </case>
+  </sav>
+</spss>
+`
+
+// roundTrip converts an xsav document with a sav named s to a sav file in dir
+// and back to an xsav document
+func roundTrip(t *testing.T, dir, xsav string) []byte {
+	opts := DefaultOptions()
+	lengths, err := FindVarLengths(strings.NewReader(xsav), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basename := filepath.Join(dir, "rt.xsav")
+	if err = ParseXSav(strings.NewReader(xsav), basename, lengths, opts); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, "rt_s.sav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewSpssReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = writeXSav(&buf, "s", r); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSavToXSavRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	first := roundTrip(t, dir, roundTripXSav)
+	second := roundTrip(t, dir, string(first))
+	if !bytes.Equal(first, second) {
+		t.Errorf("Round trip is not stable:\n%s\n---\n%s", first, second)
+	}
+
+	for _, want := range []string{
+		`name="w" width="8" decimals="3" measure="nominal" weight="true"`,
+		`<attr name="source">panel</attr>`,
+		`<mrset name="$fruit" label="Fruit" type="dichotomy" value="1">`,
+		`label="Respondent"`,
+		`<label value="2">Always</label>`,
+		`<missing low="-9" high="-1">`,
+		`<missing value="NA">`,
+		`width="300"`,
+		`a remark that is quite long`,
+		`<val name="born">5-Mar-2009</val>`,
+		`<val name="seen">5-Mar-2009 13:13:37.25</val>`,
+		`<attr name="scale">frequency</attr>`,
+	} {
+		if !bytes.Contains(first, []byte(want)) {
+			t.Errorf("Round trip lost %s:\n%s", want, first)
+		}
+	}
+	if bytes.Index(first, []byte("<mrset")) > bytes.Index(first, []byte("<var")) {
+		t.Errorf("Multiple response sets must come before the variables:\n%s", first)
+	}
+	if bytes.Index(first, []byte(`<attr name="scale">`)) > bytes.Index(first, []byte(`<missing value="-99">`)) {
+		t.Errorf("The attributes of a variable must come before its missing values:\n%s", first)
+	}
+}
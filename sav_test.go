@@ -0,0 +1,398 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var errDiskFull = errors.New("disk full")
+
+// limitedFile is a file that can only hold a limited number of bytes
+type limitedFile struct {
+	size, pos, limit int64
+}
+
+func (f *limitedFile) Write(p []byte) (int, error) {
+	if f.pos+int64(len(p)) > f.limit {
+		return 0, errDiskFull
+	}
+	f.pos += int64(len(p))
+	if f.pos > f.size {
+		f.size = f.pos
+	}
+	return len(p), nil
+}
+
+func (f *limitedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 1:
+		offset += f.pos
+	case 2:
+		offset += f.size
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// writeTestSav writes a sav with a numeric and a string variable and n cases
+func writeTestSav(w *SpssWriter, n int) error {
+	if err := w.AddVar(&Var{Name: "id", Type: SPSS_NUMERIC, Print: SPSS_FMT_F, Width: 8}); err != nil {
+		return err
+	}
+	if err := w.AddVar(&Var{Name: "name", Type: 200, Kind: KindString, Print: SPSS_FMT_A, Width: 40}); err != nil {
+		return err
+	}
+	if err := w.Start("Test"); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		w.ClearCase()
+		w.SetVar("id", "1")
+		w.SetVar("name", strings.Repeat("x", 200))
+		if err := w.WriteCase(); err != nil {
+			return err
+		}
+	}
+	return w.Finish()
+}
+
+func TestSpssWriterWriteErrors(t *testing.T) {
+	for _, compression := range []int32{SPSS_COMPRESS_NONE, SPSS_COMPRESS_BYTECODE, SPSS_COMPRESS_ZLIB} {
+		full := &limitedFile{limit: 1 << 30}
+		w := NewSpssWriter(full)
+		w.Compression = compression
+		if err := writeTestSav(w, 1000); err != nil {
+			t.Fatalf("compression %d: %s", compression, err)
+		}
+		for _, limit := range []int64{10, full.size / 4, full.size - 1} {
+			w := NewSpssWriter(&limitedFile{limit: limit})
+			w.Compression = compression
+			if err := writeTestSav(w, 1000); err != errDiskFull {
+				t.Errorf("compression %d, file of %d bytes: error %v, want %v", compression, limit, err, errDiskFull)
+			}
+		}
+	}
+}
+
+func TestParseXSavRemovesUnfinishedSav(t *testing.T) {
+	dir := t.TempDir()
+	basename := filepath.Join(dir, "p.xsav")
+	xsav := `<spss>
+<sav name="good"><dict><var name="a" type="numeric"/></dict><case><val name="a">1</val></case></sav>
+<sav name="bad"><dict><var name="a" type="numeric"/></dict><case><val name="b">1</val></case></sav>
+</spss>`
+	err := ParseXSav(strings.NewReader(xsav), basename, nil, DefaultOptions())
+	var unknown *UnknownVarError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("error %v, want an UnknownVarError", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "p_good.sav")); err != nil {
+		t.Errorf("finished sav is missing: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "p_bad.sav")); !os.IsNotExist(err) {
+		t.Errorf("unfinished sav is not removed: %v", err)
+	}
+}
+
+func TestParseXSavToCsvRemovesUnfinishedCsv(t *testing.T) {
+	dir := t.TempDir()
+	xsav := `<spss><sav name="bad"><dict><var name="a" type="numeric"/></dict><case><val name="b">1</val></case></sav></spss>`
+	if err := ParseXSavToCsv(strings.NewReader(xsav), filepath.Join(dir, "p.xsav"), nil); err == nil {
+		t.Fatal("no error for an unknown variable")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p_bad.csv")); !os.IsNotExist(err) {
+		t.Errorf("unfinished csv is not removed: %v", err)
+	}
+}
+
+func TestSpssWriterProblemBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		strict    bool
+		maxErrors int
+		inValue   []bool // the problems, true for a problem in a value
+		failAt    int    // index of the problem that fails, -1 when all are tolerated
+		tolerated int
+	}{
+		{"default values", false, 0, []bool{true, true, true}, -1, 3},
+		{"default other", false, 0, []bool{true, false, true}, 1, 1},
+		{"strict", true, 0, []bool{true}, 0, 0},
+		{"strict other", true, 0, []bool{false}, 0, 0},
+		{"budget", false, 3, []bool{true, false, false}, -1, 3},
+		{"budget exceeded", false, 2, []bool{false, true, true, true}, 2, 2},
+	}
+	for _, test := range tests {
+		w := NewSpssWriter(&limitedFile{limit: 1 << 20})
+		w.Strict = test.strict
+		w.MaxErrors = test.maxErrors
+		failAt := -1
+		for i, inValue := range test.inValue {
+			problem := errors.New("problem")
+			err := w.problem(problem, inValue, "", "ignored")
+			if err != nil {
+				if !errors.Is(err, problem) {
+					t.Errorf("%s: error %v does not wrap the problem", test.name, err)
+				}
+				var max *MaxErrorsError
+				if errors.As(err, &max) != (test.maxErrors > 0) {
+					t.Errorf("%s: error %v, want a MaxErrorsError only with a budget", test.name, err)
+				}
+				failAt = i
+				break
+			}
+		}
+		if failAt != test.failAt || w.Problems != test.tolerated {
+			t.Errorf("%s: failed at %d with %d tolerated, want %d with %d", test.name, failAt, w.Problems, test.failAt, test.tolerated)
+		}
+	}
+}
+
+func TestParseXSavTolerated(t *testing.T) {
+	xsav := `<spss><sav name="s"><dict><var name="a" type="numeric"/></dict>
+<case><val name="a">x</val></case><case><val name="b">1</val></case></sav></spss>`
+	tests := []struct {
+		name      string
+		configure func(*Options)
+		want      string // type of the error
+	}{
+		{"default", func(o *Options) {}, "UnknownVarError"},
+		{"ignore", func(o *Options) { o.IgnoreMissingVar = true }, ""},
+		{"strict", func(o *Options) { o.Strict = true }, "ValueError"},
+		{"strict ignore", func(o *Options) { o.Strict = true; o.IgnoreMissingVar = true }, "ValueError"},
+		{"budget", func(o *Options) { o.MaxErrors = 2 }, "ToleratedError"},
+		{"small budget", func(o *Options) { o.MaxErrors = 1 }, "MaxErrorsError"},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		test.configure(opts)
+		err := ParseXSav(strings.NewReader(xsav), filepath.Join(t.TempDir(), "p.xsav"), nil, opts)
+		var unknown *UnknownVarError
+		var value *ValueError
+		var tolerated *ToleratedError
+		var max *MaxErrorsError
+		got := ""
+		switch {
+		case errors.As(err, &max):
+			got = "MaxErrorsError"
+		case errors.As(err, &unknown):
+			got = "UnknownVarError"
+		case errors.As(err, &value):
+			got = "ValueError"
+		case errors.As(err, &tolerated):
+			got = "ToleratedError"
+			if tolerated.Problems != 2 {
+				t.Errorf("%s: %d problems tolerated, want 2", test.name, tolerated.Problems)
+			}
+		case err != nil:
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("%s: error %v, want %s", test.name, err, test.want)
+		}
+	}
+}
+
+func TestStrictIgnoreReportsUnknownVar(t *testing.T) {
+	w := NewSpssWriter(&limitedFile{limit: 1 << 20})
+	w.IgnoreMissingVar = true
+	if err := w.SetVar("nope", "1"); err != nil {
+		t.Errorf("ignored variable gives error %v", err)
+	}
+	w.Strict = true
+	var unknown *UnknownVarError
+	if err := w.SetVar("nope", "1"); !errors.As(err, &unknown) {
+		t.Errorf("strict mode gives error %v for an unknown variable, want an UnknownVarError", err)
+	}
+}
+
+func TestAttributeQuoting(t *testing.T) {
+	attributes := []Attribute{{"q", "it's"}, {"q", "two\nlines"}, {"r", "'quoted'"}}
+	var buf bytes.Buffer
+	writeAttributes(&buf, attributes)
+	if want := "q('it''s'\n'two lines'\n)r('''quoted'''\n)"; buf.String() != want {
+		t.Errorf("attributes are written as %q, want %q", buf.String(), want)
+	}
+	got, rest, err := parseAttributes(buf.String())
+	if err != nil || rest != "" {
+		t.Fatalf("parsing gives error %v with %q left", err, rest)
+	}
+	want := []Attribute{{"q", "it's"}, {"q", "two lines"}, {"r", "'quoted'"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("attributes are read as %q, want %q", got, want)
+	}
+}
+
+func TestWrapLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{""}},
+		{"short line", []string{"short line"}},
+		{strings.Repeat("x", 80), []string{strings.Repeat("x", 80)}},
+		{strings.Repeat("x", 75) + " word  more", []string{strings.Repeat("x", 75) + " word", "more"}},
+		{strings.Repeat("x", 85), []string{strings.Repeat("x", 80), "xxxxx"}},
+		{strings.Repeat("x", 79) + "éé", []string{strings.Repeat("x", 79), "éé"}},
+	}
+	for _, test := range tests {
+		got := wrapLine(test.line, 80)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("wrapLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+// writeTestFile writes a sav with writeTestSav and the given compression and
+// returns its contents
+func writeTestFile(t *testing.T, compression int32, n int) []byte {
+	filename := filepath.Join(t.TempDir(), "t.sav")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewSpssWriter(f)
+	w.Compression = compression
+	err = writeTestSav(w, n)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestZsavOffsets(t *testing.T) {
+	b := writeTestFile(t, SPSS_COMPRESS_ZLIB, 20000) // more than one block
+	r, err := NewSpssReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zheader struct{ HeaderOffset, TrailerOffset, TrailerLength int64 }
+	binary.Read(bytes.NewReader(b[r.DataOffset:]), endian, &zheader)
+	if zheader.HeaderOffset != r.DataOffset {
+		t.Errorf("zheader_ofs is %d, want %d", zheader.HeaderOffset, r.DataOffset)
+	}
+	if zheader.TrailerOffset+zheader.TrailerLength != int64(len(b)) {
+		t.Fatalf("ztrailer at %d with length %d does not end the file of %d bytes",
+			zheader.TrailerOffset, zheader.TrailerLength, len(b))
+	}
+
+	trailer := bytes.NewReader(b[zheader.TrailerOffset:])
+	var head struct {
+		Bias, Zero         int64
+		BlockSize, NBlocks int32
+	}
+	binary.Read(trailer, endian, &head)
+	if head.NBlocks < 2 || zheader.TrailerLength != 24+24*int64(head.NBlocks) {
+		t.Fatalf("ztrailer has %d blocks in %d bytes, want at least 2 blocks of 24 bytes after 24 bytes",
+			head.NBlocks, zheader.TrailerLength)
+	}
+	uncompressed, compressed := zheader.HeaderOffset, zheader.HeaderOffset+24
+	for i := 0; i < int(head.NBlocks); i++ {
+		var block struct {
+			UncompressedOffset, CompressedOffset int64
+			UncompressedSize, CompressedSize     int32
+		}
+		binary.Read(trailer, endian, &block)
+		if block.UncompressedOffset != uncompressed || block.CompressedOffset != compressed {
+			t.Errorf("block %d is at %d and %d, want %d and %d", i,
+				block.UncompressedOffset, block.CompressedOffset, uncompressed, compressed)
+		}
+		uncompressed += int64(block.UncompressedSize)
+		compressed += int64(block.CompressedSize)
+	}
+	if compressed != zheader.TrailerOffset {
+		t.Errorf("blocks end at %d, want the ztrailer at %d", compressed, zheader.TrailerOffset)
+	}
+
+	cases := 0
+	for r.ReadCase() == nil {
+		cases++
+	}
+	if cases != 20000 {
+		t.Errorf("read %d cases, want 20000", cases)
+	}
+}
+
+func TestUncompressedCaseSize(t *testing.T) {
+	b := writeTestFile(t, SPSS_COMPRESS_NONE, 3)
+	r, err := NewSpssReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// id takes 1 element and the 200 bytes of name take 25
+	if r.Compression != SPSS_COMPRESS_NONE || r.CaseSize != 26 {
+		t.Errorf("compression %d with case size %d, want 0 and 26", r.Compression, r.CaseSize)
+	}
+	if size := int64(len(b)) - r.DataOffset; size != 3*26*8 {
+		t.Errorf("case data is %d bytes, want 3 cases of 26 elements", size)
+	}
+	for i := 0; i < 3; i++ {
+		if err = r.ReadCase(); err != nil {
+			t.Fatal(err)
+		}
+		if id, name := r.DictMap["id"].Value, r.DictMap["name"].Value; id != "1" || name != strings.Repeat("x", 200) {
+			t.Errorf("case %d is %s and %s", i+1, id, name)
+		}
+	}
+}
+
+func TestLangFallback(t *testing.T) {
+	langs := []string{"fr", "nl"}
+	tests := []struct {
+		label        string
+		translations []Translation
+		want         string
+	}{
+		{"Often", []Translation{{"nl", "Vaak"}, {"fr", "Souvent"}}, "Souvent"},
+		{"Often", []Translation{{"en", "Frequently"}, {"NL", "Vaak"}}, "Vaak"},
+		{"Often", []Translation{{"en", "Frequently"}}, "Often"},
+		{"", []Translation{{"en", "Frequently"}, {"de", "Oft"}}, "Frequently"},
+		{"", nil, ""},
+	}
+	for _, test := range tests {
+		v := &Var{Label: test.label, Translations: test.translations}
+		if got := v.label(langs); got != test.want {
+			t.Errorf("label %q with %v gives %q, want %q", test.label, test.translations, got, test.want)
+		}
+	}
+
+	v := &Var{Labels: []Label{
+		{"1", "Never", ""}, {"1", "Nooit", "nl"}, {"1", "Jamais", "fr"},
+		{"2", "Always", ""}, {"2", "Altijd", "nl"},
+		{"3", "Sometimes", ""}, {"3", "Manchmal", "de"},
+		{"4", "Immer", "de"},
+	}}
+	want := []Label{{"1", "Jamais", "fr"}, {"2", "Altijd", "nl"}, {"3", "Sometimes", ""}, {"4", "Immer", "de"}}
+	if got := v.valueLabels(langs); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("value labels are %v, want %v", got, want)
+	}
+}
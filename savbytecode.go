@@ -17,12 +17,14 @@ GNU General Public License for more details.
 You should have received a copy of the GNU General Public License
 along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
 */
-package main
+package xml2sav
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"math"
 	"strings"
 )
 
@@ -111,3 +113,87 @@ func (w *BytecodeWriter) Flush() error {
 	}
 	return w.checkAndWrite()
 }
+
+// BytecodeReader reads the cases of a bytecode compressed sav file
+type BytecodeReader struct {
+	io.Reader
+	bias    float64
+	command [8]byte
+	index   int
+}
+
+func NewBytecodeReader(r io.Reader, bias float64) *BytecodeReader {
+	return &BytecodeReader{Reader: r, bias: bias, index: 8}
+}
+
+// next returns the next code, skipping the padding
+func (r *BytecodeReader) next() (byte, error) {
+	for {
+		if r.index >= len(r.command) {
+			if _, err := io.ReadFull(r.Reader, r.command[:]); err != nil {
+				return 0, err
+			}
+			r.index = 0
+		}
+		code := r.command[r.index]
+		r.index++
+		if code == 252 {
+			return 0, io.EOF
+		}
+		if code != 0 {
+			return code, nil
+		}
+	}
+}
+
+func (r *BytecodeReader) readData() ([]byte, error) {
+	b := make([]byte, 8)
+	_, err := io.ReadFull(r.Reader, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+func (r *BytecodeReader) ReadNumber() (float64, bool, error) {
+	code, err := r.next()
+	if err != nil {
+		return 0, false, err
+	}
+	switch code {
+	case 253:
+		b, err := r.readData()
+		return math.Float64frombits(endian.Uint64(b)), false, err
+	case 254:
+		return 0, false, errors.New("Found a string in the compressed data where a number was expected")
+	case 255:
+		return 0, true, nil
+	}
+	return float64(code) - r.bias, false, nil
+}
+
+func (r *BytecodeReader) ReadString(elements int) (string, error) {
+	buf := make([]byte, 0, elements*8)
+	for i := 0; i < elements; i++ {
+		code, err := r.next()
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		switch code {
+		case 253:
+			b, err := r.readData()
+			if err != nil {
+				return "", err
+			}
+			buf = append(buf, b...)
+		case 254:
+			buf = append(buf, "        "...)
+		default:
+			return "", errors.New("Found a number in the compressed data where a string was expected")
+		}
+	}
+	return string(buf), nil
+}
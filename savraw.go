@@ -0,0 +1,76 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// RawWriter writes the cases of an uncompressed sav file, every element is
+// written as 8 bytes.
+type RawWriter struct {
+	io.Writer
+}
+
+func NewRawWriter(w io.Writer) *RawWriter {
+	return &RawWriter{Writer: w}
+}
+
+func (w *RawWriter) WriteMissing() error {
+	return w.WriteNumber(-math.MaxFloat64)
+}
+
+func (w *RawWriter) WriteNumber(number float64) error {
+	return binary.Write(w.Writer, endian, number)
+}
+
+func (w *RawWriter) WriteString(val string, elements int) error {
+	_, err := w.Write(stob(val, elements*8))
+	return err
+}
+
+func (w *RawWriter) Flush() error {
+	return nil
+}
+
+// RawReader reads the cases of an uncompressed sav file
+type RawReader struct {
+	io.Reader
+}
+
+func NewRawReader(r io.Reader) *RawReader {
+	return &RawReader{Reader: r}
+}
+
+func (r *RawReader) ReadNumber() (float64, bool, error) {
+	var f float64
+	if err := binary.Read(r.Reader, endian, &f); err != nil {
+		return 0, false, err
+	}
+	return f, f == -math.MaxFloat64, nil
+}
+
+func (r *RawReader) ReadString(elements int) (string, error) {
+	b := make([]byte, elements*8)
+	_, err := io.ReadFull(r.Reader, b)
+	return string(b), err
+}
@@ -0,0 +1,689 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// caseReader reads the elements of the cases, it is implemented by
+// BytecodeReader for compressed and RawReader for uncompressed files
+type caseReader interface {
+	ReadNumber() (number float64, missing bool, err error)
+	ReadString(elements int) (string, error)
+}
+
+type varRecord struct {
+	index    int32 // index of the first element
+	typ      int32
+	label    string
+	missing  [][]byte
+	nMissing int32
+	print    int32
+	name     string
+	measure  int32 // display parameters
+	width    int32
+	align    int32
+}
+
+type valueLabelRecord struct {
+	values  [][]byte
+	labels  []string
+	indexes []int32
+}
+
+type extensionRecord struct {
+	subtype int32
+	data    []byte
+}
+
+// RecordInfo describes where a record is found in the file
+type RecordInfo struct {
+	Offset  int64
+	Length  int64
+	Type    int32
+	Subtype int32  // Subtype of type 7 records
+	Name    string // Short name of type 2 records
+}
+
+// SpssReader reads the dictionary and the cases of a sav file
+type SpssReader struct {
+	r           *bufio.Reader
+	err         error
+	offset      int64
+	cases       caseReader
+	Product     string
+	Layout      int32
+	CaseSize    int32 // nominal_case_size
+	Created     string
+	FileLabel   string
+	Compression int32
+	Bias        float64
+	Count       int32 // Number of cases, -1 if unknown
+	Dict        []*Var
+	DictMap     map[string]*Var // Long variable names index
+	ShortMap    map[string]*Var // Short variable names index
+	Weight      *Var
+	MRSets      []*MRSet
+	Attributes  []Attribute
+	Documents   []string
+	Encoding    string
+	Records     []RecordInfo // Records of the dictionary in file order
+	DataOffset  int64        // Offset of the case data
+	read        int32        // cases read so far
+
+	weightIndex int32
+	records     []*varRecord
+	valueLabels []*valueLabelRecord
+	extensions  []*extensionRecord
+}
+
+// NewSpssReader reads the header and the dictionary of a sav file, after
+// which the cases can be read with ReadCase
+func NewSpssReader(r io.Reader) (*SpssReader, error) {
+	in := &SpssReader{
+		r:        bufio.NewReader(r),
+		DictMap:  make(map[string]*Var),
+		ShortMap: make(map[string]*Var),
+	}
+	if err := in.headerRecord(); err != nil {
+		return nil, err
+	}
+	if err := in.dictionaryRecords(); err != nil {
+		return nil, err
+	}
+	if err := in.buildDict(); err != nil {
+		return nil, err
+	}
+
+	switch in.Compression {
+	case SPSS_COMPRESS_NONE:
+		in.cases = NewRawReader(in.r)
+	case SPSS_COMPRESS_BYTECODE:
+		in.cases = NewBytecodeReader(in.r, in.Bias)
+	case SPSS_COMPRESS_ZLIB:
+		z, err := newZlibReader(in.r)
+		if err != nil {
+			return nil, err
+		}
+		in.cases = NewBytecodeReader(z, in.Bias)
+	default:
+		return nil, fmt.Errorf("Unknown compression %d", in.Compression)
+	}
+	return in, nil
+}
+
+func (in *SpssReader) readBytes(n int) []byte {
+	if n < 0 {
+		n = 0
+		if in.err == nil {
+			in.err = errors.New("Invalid length in sav file")
+		}
+	}
+	b := make([]byte, n)
+	if in.err == nil {
+		in.offset += int64(n)
+		if _, err := io.ReadFull(in.r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			in.err = err
+		}
+	}
+	return b
+}
+
+func (in *SpssReader) readInt32() int32 {
+	return int32(endian.Uint32(in.readBytes(4)))
+}
+
+func (in *SpssReader) readFloat64() float64 {
+	return math.Float64frombits(endian.Uint64(in.readBytes(8)))
+}
+
+func (in *SpssReader) readString(n int) string {
+	return strings.TrimRight(string(in.readBytes(n)), " \x00")
+}
+
+func (in *SpssReader) headerRecord() error {
+	recType := string(in.readBytes(4))                     // rec_type
+	in.Product = in.readString(60)                         // prod_name
+	in.Layout = in.readInt32()                             // layout_code
+	in.CaseSize = in.readInt32()                           // nominal_case_size
+	in.Compression = in.readInt32()                        // compression
+	in.weightIndex = in.readInt32()                        // weight_index
+	in.Count = in.readInt32()                              // ncases
+	in.Bias = in.readFloat64()                             // bias
+	in.Created = in.readString(9) + " " + in.readString(8) // creation_date, creation_time
+	in.FileLabel = in.readString(64)                       // file_label
+	in.readBytes(3)                                        // padding
+	if in.err != nil {
+		return in.err
+	}
+	in.Records = append(in.Records, RecordInfo{Offset: 0, Length: in.offset, Name: recType})
+
+	if recType != "$FL2" && recType != "$FL3" {
+		return errors.New("Not a SPSS sav file")
+	}
+	if in.Layout != 2 && in.Layout != 3 {
+		return errors.New("Only little endian sav files are supported")
+	}
+	return nil
+}
+
+func (in *SpssReader) dictionaryRecords() error {
+	index := int32(1)
+	var labels *valueLabelRecord // waiting for its variable index record
+	for in.err == nil {
+		info := RecordInfo{Offset: in.offset}
+		info.Type = in.readInt32()
+		if labels != nil && info.Type != 4 && in.err == nil {
+			return errors.New("Value label record is not followed by a variable index record")
+		}
+		switch info.Type {
+		case 2:
+			r := in.variableRecord()
+			if r.typ != -1 {
+				r.index = index
+				in.records = append(in.records, r)
+				info.Name = r.name
+			}
+			index++
+		case 3:
+			labels = in.valueLabelRecord()
+		case 4:
+			if labels == nil {
+				return errors.New("Variable index record without value labels")
+			}
+			count := int(in.readInt32()) // var_count
+			for i := 0; i < count && in.err == nil; i++ {
+				labels.indexes = append(labels.indexes, in.readInt32())
+			}
+			in.valueLabels = append(in.valueLabels, labels)
+			labels = nil
+		case 6:
+			n := int(in.readInt32()) // n_lines
+			for i := 0; i < n && in.err == nil; i++ {
+				in.Documents = append(in.Documents, in.readString(80))
+			}
+		case 7:
+			info.Subtype = in.readInt32()
+			size := in.readInt32()
+			count := in.readInt32()
+			if size < 0 || count < 0 || int64(size)*int64(count) > math.MaxInt32 {
+				return fmt.Errorf("Invalid size for extension record %d", info.Subtype)
+			}
+			data := in.readBytes(int(size * count))
+			in.extensions = append(in.extensions, &extensionRecord{info.Subtype, data})
+		case 999:
+			in.readInt32() // filler
+			in.DataOffset = in.offset
+		default:
+			if in.err == nil {
+				return fmt.Errorf("Unknown record type %d", info.Type)
+			}
+		}
+		info.Length = in.offset - info.Offset
+		in.Records = append(in.Records, info)
+		if info.Type == 999 {
+			break
+		}
+	}
+	return in.err
+}
+
+func (in *SpssReader) variableRecord() *varRecord {
+	r := new(varRecord)
+	r.typ = in.readInt32()      // type
+	hasLabel := in.readInt32()  // has_var_label
+	r.nMissing = in.readInt32() // n_missing_values
+	r.print = in.readInt32()    // print
+	in.readInt32()              // write
+	r.name = in.readString(8)   // name
+	if hasLabel == 1 {
+		l := int(in.readInt32()) // label_len
+		r.label = string(in.readBytes((l + 3) / 4 * 4))
+		if l >= 0 && l < len(r.label) {
+			r.label = r.label[:l]
+		}
+	}
+	n := r.nMissing
+	if n < 0 {
+		n = -n
+	}
+	for i := int32(0); i < n; i++ {
+		r.missing = append(r.missing, in.readBytes(8))
+	}
+	return r
+}
+
+func (in *SpssReader) valueLabelRecord() *valueLabelRecord {
+	r := new(valueLabelRecord)
+	count := int(in.readInt32()) // label_count
+	for i := 0; i < count && in.err == nil; i++ {
+		r.values = append(r.values, in.readBytes(8)) // value
+		l := int(in.readBytes(1)[0])                 // label_len
+		r.labels = append(r.labels, string(in.readBytes((l+8)/8*8 - 1)[:l]))
+	}
+	return r
+}
+
+// lookupVar finds a variable by its long or its short name
+func (in *SpssReader) lookupVar(name string) *Var {
+	if v, found := in.DictMap[name]; found {
+		return v
+	}
+	return in.ShortMap[strings.ToUpper(name)]
+}
+
+func (in *SpssReader) buildDict() error {
+	names := make(map[string]string)
+	widths := make(map[string]int32)
+	var display []byte
+	for _, e := range in.extensions {
+		switch e.subtype {
+		case 11:
+			display = e.data
+		case 13:
+			for _, p := range strings.Split(string(e.data), "\t") {
+				if i := strings.IndexByte(p, '='); i > 0 {
+					names[p[:i]] = p[i+1:]
+				}
+			}
+		case 14:
+			for _, p := range strings.Split(string(e.data), "\t") {
+				p = strings.TrimRight(p, "\x00")
+				if i := strings.IndexByte(p, '='); i > 0 {
+					w, err := strconv.Atoi(p[i+1:])
+					if err != nil {
+						return fmt.Errorf("Invalid very long string width for %s", p[:i])
+					}
+					widths[p[:i]] = int32(w)
+				}
+			}
+		case 20:
+			in.Encoding = string(e.data)
+		}
+	}
+
+	// Measurement levels are stored per segment
+	n := len(in.records)
+	for i, r := range in.records {
+		r.measure = SPSS_MLVL_NOM
+		if len(display) == n*12 {
+			r.measure = int32(endian.Uint32(display[i*12:]))
+			r.width = int32(endian.Uint32(display[i*12+4:]))
+			r.align = int32(endian.Uint32(display[i*12+8:]))
+		} else if len(display) == n*8 {
+			r.measure = int32(endian.Uint32(display[i*8:]))
+			r.align = int32(endian.Uint32(display[i*8+4:]))
+		}
+	}
+
+	elements := make(map[int32]*Var)
+	for i := 0; i < len(in.records); i++ {
+		r := in.records[i]
+		v := new(Var)
+		v.Index = r.index
+		v.ShortName = r.name
+		v.Name = r.name
+		if long, found := names[r.name]; found {
+			v.Name = long
+		}
+		v.Type = r.typ
+		v.Segments = 1
+		if w, found := widths[r.name]; found {
+			v.Type = w
+			v.Segments = (int(w) + 251) / 252
+			if i+v.Segments > len(in.records) {
+				return fmt.Errorf("Missing segments for very long string %s", v.Name)
+			}
+		}
+		v.Print = byte(r.print >> 16)
+		v.Width = byte(r.print >> 8)
+		v.Decimals = byte(r.print)
+		switch {
+		case v.Type > 0:
+			v.Kind = KindString
+		case v.Print == SPSS_FMT_DATE_TIME || v.Print == SPSS_FMT_YMDHMS:
+			v.Kind = KindDateTime
+		case formats[v.Print].date:
+			v.Kind = KindDate
+		case v.Print == SPSS_FMT_TIME:
+			v.Kind = KindTime
+		case v.Print == SPSS_FMT_DTIME:
+			v.Kind = KindDuration
+		}
+		if v.Type > 0 {
+			v.Width = byte(maxPrintStringWidth)
+			if v.Type < int32(maxPrintStringWidth) {
+				v.Width = byte(v.Type)
+			}
+		}
+		v.Measure = r.measure
+		v.Label = r.label
+		in.recordMissing(v, r)
+
+		in.Dict = append(in.Dict, v)
+		in.DictMap[v.Name] = v
+		in.ShortMap[v.ShortName] = v
+		elements[v.Index] = v
+		if v.Index == in.weightIndex {
+			in.Weight = v
+		}
+		i += v.Segments - 1
+	}
+
+	for _, r := range in.valueLabels {
+		for _, index := range r.indexes {
+			v, found := elements[index]
+			if !found {
+				return fmt.Errorf("Value labels for unknown variable index %d", index)
+			}
+			for i := range r.values {
+				v.Labels = append(v.Labels, Label{in.rawValue(v, r.values[i]), r.labels[i], ""})
+			}
+		}
+	}
+
+	for _, e := range in.extensions {
+		var err error
+		switch e.subtype {
+		case 7, 19:
+			err = in.multipleResponseSets(e.data)
+		case 17:
+			in.Attributes, _, err = parseAttributes(string(e.data))
+		case 18:
+			err = in.variableAttributes(string(e.data))
+		case 21:
+			err = in.longStringValueLabels(e.data)
+		case 22:
+			err = in.longStringMissingValues(e.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rawValue converts an 8 byte value from the dictionary to a string
+func (in *SpssReader) rawValue(v *Var, b []byte) string {
+	if v.Type > 0 {
+		return strings.TrimRight(string(b), " ")
+	}
+	return formatNumber(math.Float64frombits(endian.Uint64(b)))
+}
+
+func (in *SpssReader) recordMissing(v *Var, r *varRecord) {
+	values := make([]string, len(r.missing))
+	for i, m := range r.missing {
+		values[i] = in.rawValue(v, m)
+	}
+	if r.nMissing < 0 {
+		v.MissingLow = values[0]
+		v.MissingHigh = values[1]
+		v.HasMissingRange = true
+		values = values[2:]
+	}
+	v.Missing = values
+}
+
+// byteReader reads the binary data of an extension record
+type byteReader struct {
+	*bytes.Reader
+	err error
+}
+
+func (r *byteReader) int32() int32 {
+	var i int32
+	if r.err == nil {
+		r.err = binary.Read(r, endian, &i)
+	}
+	return i
+}
+
+func (r *byteReader) string(n int32) string {
+	if n < 0 || int64(n) > int64(r.Len()) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b)
+}
+
+func (in *SpssReader) longStringValueLabels(data []byte) error {
+	r := &byteReader{Reader: bytes.NewReader(data)}
+	for r.Len() > 0 && r.err == nil {
+		name := r.string(r.int32()) // var_name
+		r.int32()                   // var_width
+		n := r.int32()              // n_labels
+		v := in.lookupVar(name)
+		if v == nil && r.err == nil {
+			return fmt.Errorf("Long string value labels for unknown variable %s", name)
+		}
+		for i := int32(0); i < n && r.err == nil; i++ {
+			value := r.string(r.int32()) // value
+			desc := r.string(r.int32())  // label
+			v.Labels = append(v.Labels, Label{strings.TrimRight(value, " "), desc, ""})
+		}
+	}
+	return r.err
+}
+
+func (in *SpssReader) longStringMissingValues(data []byte) error {
+	r := &byteReader{Reader: bytes.NewReader(data)}
+	for r.Len() > 0 && r.err == nil {
+		name := r.string(r.int32()) // var_name
+		n, _ := r.ReadByte()        // n_missing_values
+		l := r.int32()              // value_len
+		v := in.lookupVar(name)
+		if v == nil && r.err == nil {
+			return fmt.Errorf("Long string missing values for unknown variable %s", name)
+		}
+		for i := byte(0); i < n && r.err == nil; i++ {
+			v.Missing = append(v.Missing, strings.TrimRight(r.string(l), " "))
+		}
+	}
+	return r.err
+}
+
+// multipleResponseSets parses the sets in a subtype 7 or 19 record
+func (in *SpssReader) multipleResponseSets(data []byte) error {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		m := new(MRSet)
+		i := strings.IndexByte(line, '=')
+		if i < 0 || len(line) < i+2 {
+			return fmt.Errorf("Invalid multiple response set %s", line)
+		}
+		m.Name = line[:i]
+		kind := line[i+1]
+		rest := line[i+2:]
+
+		var ok bool
+		switch kind {
+		case 'C':
+			ok = true
+		case 'E':
+			m.CountedLabels = true
+			rest = strings.TrimPrefix(rest, " ")
+			if j := strings.IndexByte(rest, ' '); j >= 0 { // skip the label source
+				rest = rest[j+1:]
+			}
+			fallthrough
+		case 'D':
+			m.Dichotomy = true
+			m.CountedValue, rest, ok = counted(rest)
+		}
+		if ok && strings.HasPrefix(rest, " ") {
+			m.Label, rest, ok = counted(rest[1:])
+		}
+		if !ok {
+			return fmt.Errorf("Invalid multiple response set %s", line)
+		}
+
+		for _, name := range strings.Fields(rest) {
+			v := in.lookupVar(name)
+			if v == nil {
+				return fmt.Errorf("Multiple response set %s refers to unknown variable %s", m.Name, name)
+			}
+			m.Vars = append(m.Vars, v)
+		}
+		in.MRSets = append(in.MRSets, m)
+	}
+	return nil
+}
+
+// counted parses a string that is preceded by its length, like "5 Fruit"
+func counted(s string) (string, string, bool) {
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return "", s, false
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil || n < 0 || len(s) < i+1+n {
+		return "", s, false
+	}
+	return s[i+1 : i+1+n], s[i+1+n:], true
+}
+
+// parseAttributes parses a set of attributes like name('value'\n'value'\n)
+// and returns the remaining text
+func parseAttributes(s string) ([]Attribute, string, error) {
+	var attributes []Attribute
+	for s != "" && s[0] != '/' {
+		i := strings.IndexByte(s, '(')
+		if i <= 0 {
+			return nil, s, fmt.Errorf("Invalid attribute %s", s)
+		}
+		name := s[:i]
+		s = s[i+1:]
+		for !strings.HasPrefix(s, ")") {
+			if !strings.HasPrefix(s, "'") {
+				return nil, s, fmt.Errorf("Invalid value for attribute %s", name)
+			}
+			j := strings.Index(s, "'\n")
+			if j < 0 {
+				return nil, s, fmt.Errorf("Invalid value for attribute %s", name)
+			}
+			attributes = append(attributes, Attribute{name, strings.Replace(s[1:j], "''", "'", -1)})
+			s = s[j+2:]
+		}
+		s = s[1:]
+	}
+	return attributes, s, nil
+}
+
+func (in *SpssReader) variableAttributes(s string) error {
+	for s != "" {
+		i := strings.IndexByte(s, ':')
+		if i <= 0 {
+			return fmt.Errorf("Invalid variable attributes %s", s)
+		}
+		v := in.lookupVar(s[:i])
+		if v == nil {
+			return fmt.Errorf("Attributes for unknown variable %s", s[:i])
+		}
+		attributes, rest, err := parseAttributes(s[i+1:])
+		if err != nil {
+			return err
+		}
+		for _, a := range attributes {
+			if a.Name == "$@Role" {
+				role, _ := strconv.Atoi(a.Value)
+				v.Role = int32(role)
+			} else {
+				v.Attributes = append(v.Attributes, a)
+			}
+		}
+		s = strings.TrimPrefix(rest, "/")
+	}
+	return nil
+}
+
+// formatValue formats a number from a case the way it is written in xsav files
+func formatValue(v *Var, f float64) string {
+	switch v.Kind {
+	case KindDate:
+		return fromSpssTime(f).Format("2-Jan-2006")
+	case KindDateTime:
+		return fromSpssTime(f).Format("2-Jan-2006 15:04:05.999999999")
+	case KindTime:
+		return formatTime(f, false)
+	case KindDuration:
+		return formatTime(f, true)
+	}
+	return formatNumber(f)
+}
+
+// ReadCase reads the next case into the Value fields of the variables, it
+// returns io.EOF when there are no more cases
+func (in *SpssReader) ReadCase() error {
+	if in.Count >= 0 && in.read >= in.Count {
+		return io.EOF
+	}
+	for i, v := range in.Dict {
+		var err error
+		if v.Type > 0 { // string
+			v.Value = ""
+			for s := 0; s < v.Segments && err == nil; s++ {
+				var p string
+				p, err = in.cases.ReadString(int(elementCount(v.SegmentWidth(s))))
+				if len(p) > int(v.SegmentWidth(s)) {
+					p = p[:v.SegmentWidth(s)]
+				}
+				v.Value += p
+			}
+			v.Value = strings.TrimRight(v.Value, " ")
+			v.HasValue = v.Value != ""
+		} else {
+			var f float64
+			var missing bool
+			f, missing, err = in.cases.ReadNumber()
+			v.Value = ""
+			v.HasValue = !missing
+			if !missing {
+				v.Value = formatValue(v, f)
+			}
+		}
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	in.read++
+	return nil
+}
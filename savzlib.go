@@ -0,0 +1,185 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const zlibBlockSize = 0x3ff000
+
+type zlibBlock struct {
+	uncompressedOffset int64
+	compressedOffset   int64
+	uncompressedSize   int32
+	compressedSize     int32
+}
+
+// ZlibWriter compresses the case data of a ZSAV file into zlib blocks and
+// writes the ZSAV header and trailer around them.
+type ZlibWriter struct {
+	io.Writer
+	bias               float64
+	headerOffset       int64 // offset of the zheader in the file
+	trailerOffset      int64 // offset of the ztrailer in the file
+	trailerLength      int64
+	offset             int64 // offset of the next compressed block
+	uncompressedOffset int64 // offset of the next block if it was not compressed
+	block              bytes.Buffer
+	blocks             []zlibBlock
+}
+
+// NewZlibWriter returns a writer for the case data, the zheader will be
+// written at offset, which must be the current position in the file.
+func NewZlibWriter(w io.Writer, offset int64, bias float64) *ZlibWriter {
+	return &ZlibWriter{
+		Writer:             w,
+		bias:               bias,
+		headerOffset:       offset,
+		offset:             offset + 24,
+		uncompressedOffset: offset,
+	}
+}
+
+// WriteHeader writes the zheader, the trailer location is filled in after Close
+func (z *ZlibWriter) WriteHeader() error {
+	return binary.Write(z.Writer, endian, []int64{
+		z.headerOffset, // zheader_ofs
+		0,              // ztrailer_ofs
+		0,              // ztrailer_len
+	})
+}
+
+func (z *ZlibWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := zlibBlockSize - z.block.Len()
+		if c > len(p) {
+			c = len(p)
+		}
+		z.block.Write(p[:c])
+		p = p[c:]
+		if z.block.Len() == zlibBlockSize {
+			if err := z.writeBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (z *ZlibWriter) writeBlock() error {
+	if z.block.Len() == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(z.block.Bytes()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if _, err := z.Writer.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	z.blocks = append(z.blocks, zlibBlock{
+		uncompressedOffset: z.uncompressedOffset,
+		compressedOffset:   z.offset,
+		uncompressedSize:   int32(z.block.Len()),
+		compressedSize:     int32(buf.Len()),
+	})
+	z.uncompressedOffset += int64(z.block.Len())
+	z.offset += int64(buf.Len())
+	z.block.Reset()
+	return nil
+}
+
+// Close compresses the remaining data and writes the ztrailer
+func (z *ZlibWriter) Close() error {
+	if err := z.writeBlock(); err != nil {
+		return err
+	}
+
+	z.trailerOffset = z.offset
+	z.trailerLength = int64(24 + 24*len(z.blocks))
+	binary.Write(z.Writer, endian, int64(-z.bias))       // bias
+	binary.Write(z.Writer, endian, int64(0))             // zero
+	binary.Write(z.Writer, endian, int32(zlibBlockSize)) // block_size
+	binary.Write(z.Writer, endian, int32(len(z.blocks))) // n_blocks
+	for _, b := range z.blocks {
+		binary.Write(z.Writer, endian, b.uncompressedOffset) // uncompressed_ofs
+		binary.Write(z.Writer, endian, b.compressedOffset)   // compressed_ofs
+		binary.Write(z.Writer, endian, b.uncompressedSize)   // uncompressed_size
+		binary.Write(z.Writer, endian, b.compressedSize)     // compressed_size
+	}
+	return nil
+}
+
+// zlibReader decompresses the blocks of a ZSAV file into one bytecode stream
+type zlibReader struct {
+	r  *bufio.Reader
+	zr io.ReadCloser
+}
+
+// newZlibReader reads the zheader, r must be positioned right after the dictionary
+func newZlibReader(r io.Reader) (*zlibReader, error) {
+	var header [3]int64 // zheader_ofs, ztrailer_ofs, ztrailer_len
+	if err := binary.Read(r, endian, &header); err != nil {
+		return nil, err
+	}
+	size := header[1] - header[0] - 24
+	if size < 0 {
+		return nil, errors.New("Invalid zlib header")
+	}
+	return &zlibReader{r: bufio.NewReader(io.LimitReader(r, size))}, nil
+}
+
+func (z *zlibReader) Read(p []byte) (int, error) {
+	for {
+		if z.zr == nil {
+			if _, err := z.r.Peek(1); err != nil {
+				return 0, err
+			}
+			zr, err := zlib.NewReader(z.r)
+			if err != nil {
+				return 0, err
+			}
+			z.zr = zr
+		}
+		n, err := z.zr.Read(p)
+		if err == io.EOF { // continue with the next block
+			z.zr.Close()
+			z.zr = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
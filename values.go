@@ -0,0 +1,373 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Date formats that are not Go layouts
+const (
+	DateFormatISO8601 = "iso8601"
+	DateFormatEpoch   = "epoch"
+)
+
+var iso8601Layouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// NumberFormat describes how numbers are written in the source data
+type NumberFormat struct {
+	Decimal  string // decimal separator, a point when empty
+	Grouping string // thousands separator, no grouping when empty
+	Currency string // currency symbol to strip, before or after the number
+	Percent  bool   // strip a trailing percent sign
+}
+
+// Parse converts a number in the format to a float. A nil format only accepts
+// plain numbers. Groups after the first one must have three digits. Apart from
+// the separators of the format, a number can only contain digits.
+func (nf *NumberFormat) Parse(s string) (float64, error) {
+	if nf == nil {
+		return strconv.ParseFloat(s, 64)
+	}
+
+	num := strings.TrimSpace(s)
+	sign := ""
+	if strings.HasPrefix(num, "-") || strings.HasPrefix(num, "+") {
+		sign, num = num[:1], strings.TrimSpace(num[1:])
+	}
+	if nf.Currency != "" {
+		num = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(num, nf.Currency), nf.Currency))
+	}
+	if nf.Percent {
+		num = strings.TrimSpace(strings.TrimSuffix(num, "%"))
+	}
+	if sign == "" && (strings.HasPrefix(num, "-") || strings.HasPrefix(num, "+")) { // like € -5
+		sign, num = num[:1], num[1:]
+	}
+
+	decimal := nf.Decimal
+	if decimal == "" {
+		decimal = "."
+	}
+	intPart, fracPart := num, ""
+	if i := strings.Index(num, decimal); i >= 0 {
+		intPart, fracPart = num[:i], num[i+len(decimal):]
+		if !isDigits(fracPart) {
+			return 0, fmt.Errorf("Invalid number %s", s)
+		}
+		fracPart = "." + fracPart
+	}
+	if nf.Grouping != "" && strings.Contains(intPart, nf.Grouping) {
+		groups := strings.Split(intPart, nf.Grouping)
+		for i, group := range groups {
+			if (i == 0 && (len(group) == 0 || len(group) > 3)) || (i > 0 && len(group) != 3) {
+				return 0, fmt.Errorf("Invalid number %s", s)
+			}
+		}
+		intPart = strings.Join(groups, "")
+	}
+	if !isDigits(intPart) {
+		return 0, fmt.Errorf("Invalid number %s", s)
+	}
+
+	f, err := strconv.ParseFloat(sign+intPart+fracPart, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid number %s", s)
+	}
+	return f, nil
+}
+
+// isDigits returns true if s only contains the digits 0 to 9
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// monthNames holds the spellings of the months per locale, the first spelling
+// is the full name. Names are lower case and compared case insensitive.
+var monthNames = map[string][12][]string{
+	"en": {
+		{"january", "jan"}, {"february", "feb"}, {"march", "mar"}, {"april", "apr"},
+		{"may"}, {"june", "jun"}, {"july", "jul"}, {"august", "aug"},
+		{"september", "sep", "sept"}, {"october", "oct"}, {"november", "nov"}, {"december", "dec"},
+	},
+	"nl": {
+		{"januari", "jan"}, {"februari", "feb"}, {"maart", "mrt", "maa"}, {"april", "apr"},
+		{"mei"}, {"juni", "jun"}, {"juli", "jul"}, {"augustus", "aug"},
+		{"september", "sep", "sept"}, {"oktober", "okt"}, {"november", "nov"}, {"december", "dec"},
+	},
+	"de": {
+		{"januar", "jan"}, {"februar", "feb"}, {"märz", "mär", "mrz", "maerz"}, {"april", "apr"},
+		{"mai"}, {"juni", "jun"}, {"juli", "jul"}, {"august", "aug"},
+		{"september", "sep", "sept"}, {"oktober", "okt"}, {"november", "nov"}, {"dezember", "dez"},
+	},
+	"fr": {
+		{"janvier", "janv", "jan"}, {"février", "févr", "fév", "fevrier", "fevr", "fev"}, {"mars", "mar"}, {"avril", "avr"},
+		{"mai"}, {"juin"}, {"juillet", "juil"}, {"août", "aout", "aoû"},
+		{"septembre", "sept", "sep"}, {"octobre", "oct"}, {"novembre", "nov"}, {"décembre", "déc", "decembre", "dec"},
+	},
+}
+
+// IsLocale returns true if month names are known for the locale
+func IsLocale(locale string) bool {
+	_, ok := monthNames[locale]
+	return ok
+}
+
+// translateMonths replaces the month names of the locale in s by the English
+// full names when full is set, else by the English abbreviations, so s can be
+// parsed by the time package.
+func translateMonths(s, locale string, full bool) string {
+	names, ok := monthNames[locale]
+	if !ok || locale == "en" {
+		return s
+	}
+
+	var buf bytes.Buffer
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if !unicode.IsLetter(runes[i]) {
+			buf.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && unicode.IsLetter(runes[j]) {
+			j++
+		}
+		word := strings.ToLower(string(runes[i:j]))
+		month := -1
+		for m := range names {
+			for _, name := range names[m] {
+				if word == name {
+					month = m
+				}
+			}
+		}
+		if month < 0 {
+			buf.WriteString(string(runes[i:j]))
+		} else {
+			if full {
+				buf.WriteString(time.Month(month + 1).String())
+			} else {
+				buf.WriteString(time.Month(month + 1).String()[:3])
+			}
+			if j < len(runes) && runes[j] == '.' { // abbreviations like févr.
+				j++
+			}
+		}
+		i = j
+	}
+	return buf.String()
+}
+
+// parseDate parses a date or datetime value. The format is empty for the
+// default dd-mmm-yyyy [hh:mm:ss], DateFormatISO8601, DateFormatEpoch for the
+// seconds since 1970 or a Go time layout. Values without an offset are taken
+// to be in the zone loc (UTC when nil) and values with an offset are converted
+// to it. The returned time holds the wall clock of loc as UTC, as SPSS has no
+// notion of zones. Month names are read in the given locale. The time of dates
+// is dropped.
+func parseDate(s, format string, kind int, loc *time.Location, locale string) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var t time.Time
+	var err error
+	switch format {
+	case "":
+		s = translateMonths(s, locale, false)
+		if kind == KindDate {
+			t, err = time.ParseInLocation("2-Jan-2006", s, loc)
+		} else {
+			t, err = time.ParseInLocation("2-Jan-2006 15:04:05", s, loc)
+		}
+	case DateFormatISO8601:
+		for _, layout := range iso8601Layouts {
+			if t, err = time.ParseInLocation(layout, s, loc); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("Invalid ISO 8601 date %s", s)
+		}
+	case DateFormatEpoch:
+		var f float64
+		if f, err = strconv.ParseFloat(s, 64); err != nil {
+			err = fmt.Errorf("Invalid epoch time %s", s)
+		}
+		sec := math.Floor(f)
+		t = time.Unix(int64(sec), int64((f-sec)*1e9))
+	default:
+		s = translateMonths(s, locale, strings.Contains(format, "January"))
+		t, err = time.ParseInLocation(format, s, loc)
+	}
+	if err != nil {
+		return t, err
+	}
+
+	t = t.In(loc)
+	if kind == KindDate {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), nil
+}
+
+// spssTime returns the number of seconds since 14 October 1582 of the time
+func spssTime(t time.Time) float64 {
+	return float64(t.Unix()+TimeOffset) + float64(t.Nanosecond())/1e9
+}
+
+// fromSpssTime returns the time of a number of seconds since 14 October 1582,
+// it is the inverse of spssTime
+func fromSpssTime(f float64) time.Time {
+	sec := math.Floor(f)
+	return time.Unix(int64(sec)-TimeOffset, int64(math.Round((f-sec)*1e9))).UTC()
+}
+
+// parseBoolean parses the common spellings of true and false into 1 and 0
+func parseBoolean(s string) (float64, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "t", "yes", "y", "on":
+		return 1, nil
+	case "0", "false", "f", "no", "n", "off":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("Invalid boolean %s", s)
+}
+
+// parseTime parses a time of day like hh:mm or hh:mm:ss into seconds
+func parseTime(s string) (float64, error) {
+	seconds, err := parseClock(s)
+	if err != nil || seconds >= 24*3600 {
+		return 0, fmt.Errorf("Invalid time %s", s)
+	}
+	return seconds, nil
+}
+
+// parseClock parses hh:mm or hh:mm:ss into seconds, without a limit on the hours
+func parseClock(s string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("Invalid time %s", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	sec := 0.0
+	var err3 error
+	if len(parts) == 3 {
+		sec, err3 = strconv.ParseFloat(parts[2], 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || h < 0 || m < 0 || m > 59 || sec < 0 || sec >= 60 {
+		return 0, fmt.Errorf("Invalid time %s", s)
+	}
+	return float64(h*3600+m*60) + sec, nil
+}
+
+var isoDurationRegExp = regexp.MustCompile(`^(-)?P(?:([\d.]+)W)?(?:([\d.]+)D)?(?:T(?:([\d.]+)H)?(?:([\d.]+)M)?(?:([\d.]+)S)?)?$`)
+
+// parseDuration parses a duration like d hh:mm:ss, hh:mm:ss or an ISO 8601
+// duration like P1DT2H30M into seconds. Years and months are not supported
+// because their length is not fixed.
+func parseDuration(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if parts := isoDurationRegExp.FindStringSubmatch(s); parts != nil {
+		if strings.HasSuffix(s, "P") || strings.HasSuffix(s, "T") {
+			return 0, fmt.Errorf("Invalid duration %s", s)
+		}
+		seconds := 0.0
+		for i, unit := range []float64{7 * 86400, 86400, 3600, 60, 1} {
+			if parts[i+2] == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(parts[i+2], 64)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid duration %s", s)
+			}
+			seconds += f * unit
+		}
+		if parts[1] == "-" {
+			seconds = -seconds
+		}
+		return seconds, nil
+	}
+
+	t := strings.TrimPrefix(s, "-")
+	days := 0
+	if i := strings.IndexByte(t, ' '); i >= 0 {
+		var err error
+		if days, err = strconv.Atoi(t[:i]); err != nil || days < 0 {
+			return 0, fmt.Errorf("Invalid duration %s", s)
+		}
+		t = strings.TrimSpace(t[i+1:])
+	}
+	seconds, err := parseClock(t)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration %s", s)
+	}
+	seconds += float64(days * 86400)
+	if strings.HasPrefix(s, "-") {
+		seconds = -seconds
+	}
+	return seconds, nil
+}
+
+// formatTime formats seconds as hh:mm:ss, with days in front when withDays
+// is set and the time is longer than a day
+func formatTime(seconds float64, withDays bool) string {
+	sign := ""
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	whole := math.Floor(seconds)
+	s := int64(whole)
+	days := ""
+	if withDays && s >= 86400 {
+		days = strconv.FormatInt(s/86400, 10) + " "
+		s %= 86400
+	}
+	frac := ""
+	if seconds > whole {
+		frac = strings.TrimPrefix(formatNumber(seconds-whole), "0")
+	}
+	return fmt.Sprintf("%s%s%02d:%02d:%02d%s", sign, days, s/3600, s/60%60, s%60, frac)
+}
@@ -0,0 +1,183 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"00:00", 0, true},
+		{"13:13:37", 13*3600 + 13*60 + 37, true},
+		{" 9:05 ", 9*3600 + 5*60, true},
+		{"23:59:59.5", 86399.5, true},
+		{"24:00", 0, false},
+		{"25:00", 0, false},
+		{"99:30", 0, false},
+		{"12:60", 0, false},
+		{"12:30:60", 0, false},
+		{"-1:00", 0, false},
+		{"12", 0, false},
+		{"1:2:3:4", 0, false},
+		{"ab:cd", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseTime(test.in)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseTime(%q) = %v, %v, want %v, ok %v", test.in, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"01:30:00", 5400, true},
+		{"99:30", 99*3600 + 30*60, true},
+		{"2 03:04:05", 2*86400 + 3*3600 + 4*60 + 5, true},
+		{"-1 00:00:10", -86410, true},
+		{"P1DT2H30M", 86400 + 2*3600 + 30*60, true},
+		{"PT1.5S", 1.5, true},
+		{"P2W", 14 * 86400, true},
+		{"-PT1M", -60, true},
+		{"P", 0, false},
+		{"P1DT", 0, false},
+		{"P1Y", 0, false},
+		{"x 01:00", 0, false},
+		{"01:60", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseDuration(test.in)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseDuration(%q) = %v, %v, want %v, ok %v", test.in, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		in     string
+		format string
+		kind   int
+		loc    *time.Location
+		locale string
+		want   string
+		ok     bool
+	}{
+		{"5-Mar-2009", "", KindDate, nil, "en", "2009-03-05 00:00:00", true},
+		{"5-Mar-2009 13:13:37", "", KindDateTime, nil, "en", "2009-03-05 13:13:37", true},
+		{"05-mrt-2009", "", KindDate, nil, "nl", "2009-03-05 00:00:00", true},
+		{"5-mei-2009 08:00:00", "", KindDateTime, nil, "nl", "2009-05-05 08:00:00", true},
+		{"5-Mär-2009", "", KindDate, nil, "de", "2009-03-05 00:00:00", true},
+		{"5-févr.-2009", "", KindDate, nil, "fr", "2009-02-05 00:00:00", true},
+		{"5-mrt-2009", "", KindDate, nil, "en", "", false},
+		{"2009-03-05", "", KindDate, nil, "en", "", false},
+		{"2009-03-05", DateFormatISO8601, KindDate, nil, "en", "2009-03-05 00:00:00", true},
+		{"2009-03-05T13:13:37Z", DateFormatISO8601, KindDateTime, nil, "en", "2009-03-05 13:13:37", true},
+		{"2009-03-05T13:13:37+02:00", DateFormatISO8601, KindDateTime, nil, "en", "2009-03-05 11:13:37", true},
+		{"2009-03-05T13:13:37.5", DateFormatISO8601, KindDateTime, nil, "en", "2009-03-05 13:13:37.5", true},
+		{"2009-03-05T23:30:00Z", DateFormatISO8601, KindDate, amsterdam, "en", "2009-03-06 00:00:00", true},
+		{"2009-07-01T12:00:00Z", DateFormatISO8601, KindDateTime, amsterdam, "en", "2009-07-01 14:00:00", true},
+		{"2009-07-01T12:00:00", DateFormatISO8601, KindDateTime, amsterdam, "en", "2009-07-01 12:00:00", true},
+		{"05/03/2009", DateFormatISO8601, KindDate, nil, "en", "", false},
+		{"1236258817", DateFormatEpoch, KindDateTime, nil, "en", "2009-03-05 13:13:37", true},
+		{"1236258817", DateFormatEpoch, KindDateTime, amsterdam, "en", "2009-03-05 14:13:37", true},
+		{"soon", DateFormatEpoch, KindDateTime, nil, "en", "", false},
+		{"05/03/2009", "02/01/2006", KindDate, nil, "en", "2009-03-05 00:00:00", true},
+		{"5 maart 2009", "2 January 2006", KindDate, nil, "nl", "2009-03-05 00:00:00", true},
+		{"2009/03/05", "02/01/2006", KindDate, nil, "en", "", false},
+	}
+	for _, test := range tests {
+		got, err := parseDate(test.in, test.format, test.kind, test.loc, test.locale)
+		if (err == nil) != test.ok {
+			t.Errorf("parseDate(%q, %q) error %v, want ok %v", test.in, test.format, err, test.ok)
+			continue
+		}
+		if test.ok && got.Format("2006-01-02 15:04:05.999999999") != test.want {
+			t.Errorf("parseDate(%q, %q) = %s, want %s", test.in, test.format, got, test.want)
+		}
+	}
+}
+
+func TestSpssTime(t *testing.T) {
+	if got := spssTime(time.Date(1582, 10, 14, 0, 0, 0, 0, time.UTC)); got != 0 {
+		t.Errorf("spssTime of the start of the Gregorian calendar = %v, want 0", got)
+	}
+	if got := spssTime(time.Date(1970, 1, 1, 0, 0, 1, 500000000, time.UTC)); got != TimeOffset+1.5 {
+		t.Errorf("spssTime of the Unix epoch = %v, want %v", got, TimeOffset+1.5)
+	}
+}
+
+func TestNumberFormatParse(t *testing.T) {
+	european := &NumberFormat{Decimal: ",", Grouping: "."}
+	commaOnly := &NumberFormat{Decimal: ","}
+	currency := &NumberFormat{Decimal: ".", Grouping: ",", Currency: "€"}
+	percent := &NumberFormat{Decimal: ",", Percent: true}
+	tests := []struct {
+		nf   *NumberFormat
+		in   string
+		want float64
+		ok   bool
+	}{
+		{nil, "3.5", 3.5, true},
+		{nil, "-1e3", -1000, true},
+		{nil, "3,5", 0, false},
+		{european, "1.234,56", 1234.56, true},
+		{european, "3,5", 3.5, true},
+		{european, "-1.234.567", -1234567, true},
+		{european, "12.34", 0, false},
+		{european, "1234,5", 1234.5, true},
+		{european, "1.2345", 0, false},
+		{european, ".234", 0, false},
+		{commaOnly, "3,5", 3.5, true},
+		{commaOnly, "1.5", 0, false},
+		{commaOnly, "1.234,5", 0, false},
+		{commaOnly, "1,5e3", 0, false},
+		{currency, "€ 1,234.5", 1234.5, true},
+		{currency, "1234€", 1234, true},
+		{currency, "-€1,234", -1234, true},
+		{currency, "€ -5", -5, true},
+		{currency, "$5", 0, false},
+		{currency, "1,23", 0, false},
+		{percent, "12,5 %", 12.5, true},
+		{percent, "-3%", -3, true},
+		{percent, "x", 0, false},
+		{percent, "", 0, false},
+	}
+	for _, test := range tests {
+		got, err := test.nf.Parse(test.in)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("%+v Parse(%q) = %v, %v, want %v, ok %v", test.nf, test.in, got, err, test.want, test.ok)
+		}
+	}
+}
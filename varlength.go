@@ -17,34 +17,170 @@ GNU General Public License for more details.
 You should have received a copy of the GNU General Public License
 along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
 */
-package main
+package xml2sav
 
 import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
+	"strings"
 )
 
-type VarLengths map[string]map[string]int
+// VarStats holds what pass 1 learned about the values of a variable
+type VarStats struct {
+	Order     int  // position of the first value of the variable in the sav
+	Length    int  // maximum length of the values
+	Count     int  // number of non-empty values
+	Numbers   int  // number of values that are numbers
+	IntDigits int  // maximum number of digits before the decimal separator
+	Decimals  int  // maximum number of decimals
+	Negative  bool // whether some numbers are negative
+	Dates     int  // number of values that are dates
+	DateTimes int  // number of values that are datetimes
+}
 
-func (l VarLengths) GetVarLength(savname, varname string) (int, error) {
+type VarLengths map[string]map[string]*VarStats
+
+func (l VarLengths) GetVarStats(savname, varname string) (*VarStats, error) {
 	sav, found := l[savname]
 	if !found {
-		return 0, fmt.Errorf("Can not find sav section with name %s\n", savname)
+		return nil, fmt.Errorf("Can not find sav section with name %s\n", savname)
 	}
-	le, found := sav[varname]
+	stats, found := sav[varname]
 	if !found {
-		return 0, fmt.Errorf("Can not find variable %s in sav section %s\n", varname, savname)
+		return nil, fmt.Errorf("Can not find variable %s in sav section %s\n", varname, savname)
+	}
+	return stats, nil
+}
+
+// VarNames returns the names of the variables of a sav in the order their first
+// value appeared
+func (l VarLengths) VarNames(savname string) []string {
+	sav := l[savname]
+	names := make([]string, len(sav))
+	for name, stats := range sav {
+		names[stats.Order] = name
+	}
+	return names
+}
+
+func (l VarLengths) GetVarLength(savname, varname string) (int, error) {
+	stats, err := l.GetVarStats(savname, varname)
+	if err != nil {
+		return 0, err
+	}
+	return stats.Length, nil
+}
+
+// addValue updates the statistics with a value, which is parsed with the number
+// format, date format and locale of the variable
+func (s *VarStats) addValue(val string, nf *NumberFormat, dateformat, locale string) {
+	if len(val) > s.Length {
+		s.Length = len(val)
+	}
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return
+	}
+	s.Count++
+
+	if f, err := nf.Parse(val); err == nil {
+		s.Numbers++
+		if f < 0 {
+			s.Negative = true
+		}
+		if digits := len(strconv.FormatFloat(math.Trunc(math.Abs(f)), 'f', 0, 64)); digits > s.IntDigits {
+			s.IntDigits = digits
+		}
+		decimal := "."
+		if nf != nil && nf.Decimal != "" {
+			decimal = nf.Decimal
+		}
+		decimals := 0
+		if i := strings.Index(val, decimal); i >= 0 {
+			for _, c := range val[i+len(decimal):] {
+				if c < '0' || c > '9' {
+					break
+				}
+				decimals++
+			}
+		}
+		if decimals > s.Decimals {
+			s.Decimals = decimals
+		}
+		return
+	}
+
+	if dateformat == DateFormatEpoch {
+		return
+	}
+	kind := KindDate
+	if strings.Contains(val, ":") {
+		kind = KindDateTime
+	}
+	if _, err := parseDate(val, dateformat, kind, nil, locale); err == nil {
+		if kind == KindDate {
+			s.Dates++
+		} else {
+			s.DateTimes++
+		}
 	}
-	return le, nil
 }
 
-func findVarLengths(r io.Reader) (VarLengths, error) {
+// inferType returns the type of a variable of type auto. For numeric variables
+// it also returns the width and decimals needed to show all values.
+func (s *VarStats) inferType() (typ string, width, decimals byte) {
+	switch {
+	case s == nil || s.Count == 0 || s.Numbers == s.Count:
+		if s == nil || s.Count == 0 {
+			return "numeric", 8, 2
+		}
+		d := s.Decimals
+		if d > 16 {
+			d = 16
+		}
+		w := s.IntDigits
+		if s.Negative {
+			w++
+		}
+		if d > 0 {
+			w += d + 1
+		}
+		if w < 8 {
+			w = 8
+		}
+		if w > 40 {
+			w = 40
+		}
+		return "numeric", byte(w), byte(d)
+	case s.Dates == s.Count:
+		return "date", 0, 0
+	case s.Dates+s.DateTimes == s.Count:
+		return "datetime", 0, 0
+	}
+	return "string", 0, 0
+}
+
+// FindVarLengths is pass 1, it determines the maximum length of the values of
+// every variable and the statistics needed to infer the type of variables of
+// type auto. Errors are returned as a PosError.
+func FindVarLengths(r io.Reader, opts *Options) (lengths VarLengths, err error) {
 	v := make(VarLengths)
 	var savName string
-	var lengths map[string]int
+	var cases, caseNr int32
+	var stats map[string]*VarStats
+	var varName string
+	var dateformat, locale string
+	var nf *NumberFormat
+	var varDateFormats map[string]string
+	var varNumberFormats map[string]*NumberFormat
 
-	decoder := xml.NewDecoder(r)
+	decoder := newPositionDecoder(r)
+	defer func() {
+		err = decoder.errorAt(err, savName, caseNr)
+	}()
 	for {
 		token, err := decoder.Token()
 		if err == io.EOF {
@@ -56,26 +192,77 @@ func findVarLengths(r io.Reader) (VarLengths, error) {
 
 		switch t := token.(type) {
 		case xml.StartElement:
-			if t.Name.Local == "sav" {
-				savName = getAttr(&t, "name")
-				lengths = make(map[string]int)
-			} else if t.Name.Local == "val" {
+			switch t.Name.Local {
+			case "sav":
+				if savName, err = getAttr(&t, "name"); err != nil {
+					return nil, err
+				}
+				stats = make(map[string]*VarStats)
+				cases = 0
+				dateformat = ""
+				if hasAttr(&t, "dateformat") {
+					dateformat, _ = getAttr(&t, "dateformat")
+				}
+				locale = opts.Locale
+				if hasAttr(&t, "locale") {
+					locale, _ = getAttr(&t, "locale")
+				}
+				nf = nil
+				varDateFormats = make(map[string]string)
+				varNumberFormats = make(map[string]*NumberFormat)
+			case "var":
+				if varName, err = getAttr(&t, "name"); err != nil {
+					return nil, err
+				}
+				if hasAttr(&t, "dateformat") {
+					varDateFormats[varName], _ = getAttr(&t, "dateformat")
+				}
+			case "case":
+				cases++
+				caseNr = cases
+			case "numberformat":
+				var nfxml numberFormatXML
+				if err = decoder.DecodeElement(&nfxml, &t); err != nil {
+					return nil, err
+				}
+				format, err := makeNumberFormat(&nfxml)
+				if err != nil {
+					return nil, err
+				}
+				if varName != "" {
+					varNumberFormats[varName] = format
+				} else {
+					nf = format
+				}
+			case "val":
 				var valxml valXML
 				if err = decoder.DecodeElement(&valxml, &t); err != nil {
 					return nil, err
 				}
-				l, found := lengths[valxml.Name]
+				s, found := stats[valxml.Name]
 				if !found {
-					l = 0
+					s = &VarStats{Order: len(stats)}
+					stats[valxml.Name] = s
 				}
-				if l < len(valxml.Value) || !found {
-					lengths[valxml.Name] = len(valxml.Value)
+				format, found := varNumberFormats[valxml.Name]
+				if !found {
+					format = nf
+				}
+				df, found := varDateFormats[valxml.Name]
+				if !found {
+					df = dateformat
 				}
+				s.addValue(valxml.Value, format, df, locale)
 			}
 		case xml.EndElement:
-			if t.Name.Local == "sav" {
-				v[savName] = lengths
-				lengths = nil
+			switch t.Name.Local {
+			case "var":
+				varName = ""
+			case "case":
+				caseNr = 0
+			case "sav":
+				v[savName] = stats
+				stats = nil
 			}
 		}
 	}
@@ -0,0 +1,85 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import "testing"
+
+func TestVarStatsAddValueDigits(t *testing.T) {
+	tests := []struct {
+		nf        *NumberFormat
+		values    []string
+		intDigits int
+		decimals  int
+		negative  bool
+	}{
+		{nil, []string{"1", "22", "333"}, 3, 0, false},
+		{nil, []string{"-12.5", "3.25"}, 2, 2, true},
+		{nil, []string{"0.5"}, 1, 1, false},
+		{&NumberFormat{Decimal: ",", Grouping: "."}, []string{"1.234.567,8"}, 7, 1, false},
+		{&NumberFormat{Decimal: ".", Grouping: ",", Currency: "€"}, []string{"€ -1,234.50"}, 4, 2, true},
+		{&NumberFormat{Decimal: ",", Percent: true}, []string{"12,5 %"}, 2, 1, false},
+	}
+	for _, test := range tests {
+		s := new(VarStats)
+		for _, v := range test.values {
+			s.addValue(v, test.nf, "", "en")
+		}
+		if s.Numbers != len(test.values) || s.IntDigits != test.intDigits || s.Decimals != test.decimals || s.Negative != test.negative {
+			t.Errorf("%v: numbers %d, digits %d, decimals %d, negative %v, want %d, %d, %d, %v", test.values,
+				s.Numbers, s.IntDigits, s.Decimals, s.Negative, len(test.values), test.intDigits, test.decimals, test.negative)
+		}
+	}
+}
+
+func TestVarStatsInferType(t *testing.T) {
+	tests := []struct {
+		values     []string
+		dateformat string
+		typ        string
+		width      byte
+		decimals   byte
+	}{
+		{nil, "", "numeric", 8, 2},
+		{[]string{"", " "}, "", "numeric", 8, 2},
+		{[]string{"1", "2", "3"}, "", "numeric", 8, 0},
+		{[]string{"1.5", "22.25"}, "", "numeric", 8, 2},
+		{[]string{"123456789012", "-1"}, "", "numeric", 13, 0},
+		{[]string{"-1234567.125"}, "", "numeric", 12, 3},
+		{[]string{"1", "x"}, "", "string", 0, 0},
+		{[]string{"5-Mar-2009", "6-Mar-2009"}, "", "date", 0, 0},
+		{[]string{"5-Mar-2009", "5-Mar-2009 13:13:37"}, "", "datetime", 0, 0},
+		{[]string{"2009-03-05", "2009-03-05T13:13:37Z"}, DateFormatISO8601, "datetime", 0, 0},
+		{[]string{"2009-03-05"}, "", "string", 0, 0},
+		{[]string{"1236258817"}, DateFormatEpoch, "numeric", 10, 0},
+	}
+	for _, test := range tests {
+		s := new(VarStats)
+		for _, v := range test.values {
+			s.addValue(v, nil, test.dateformat, "en")
+		}
+		typ, width, decimals := s.inferType()
+		if typ != test.typ || width != test.width || decimals != test.decimals {
+			t.Errorf("%v: inferred %s %d.%d, want %s %d.%d", test.values, typ, width, decimals, test.typ, test.width, test.decimals)
+		}
+	}
+	if typ, _, _ := (*VarStats)(nil).inferType(); typ != "numeric" {
+		t.Errorf("A variable without values is %s, want numeric", typ)
+	}
+}
@@ -17,7 +17,7 @@ GNU General Public License for more details.
 You should have received a copy of the GNU General Public License
 along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
 */
-package main
+package xml2sav
 
 import (
 	"encoding/xml"
@@ -27,23 +27,83 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type labelXML struct {
 	Value string `xml:"value,attr"`
+	Lang  string `xml:"lang,attr"`
 	Desc  string `xml:",chardata"`
 }
 
+type vlabelXML struct {
+	Lang string `xml:"lang,attr"`
+	Text string `xml:",chardata"`
+}
+
+type attrXML struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type labelSetXML struct {
+	ID     string      `xml:"id,attr"`
+	Labels []*labelXML `xml:"label"`
+}
+
+type missingXML struct {
+	Value string `xml:"value,attr"`
+	Low   string `xml:"low,attr"`
+	High  string `xml:"high,attr"`
+}
+
+type numberFormatXML struct {
+	Decimal  string `xml:"decimal,attr"`
+	Grouping string `xml:"grouping,attr"`
+	Currency string `xml:"currency,attr"`
+	Percent  bool   `xml:"percent,attr"`
+}
+
 type varXML struct {
-	Type     string      `xml:"type,attr"`
-	Name     string      `xml:"name,attr"`
-	Measure  string      `xml:"measure,attr"`
-	Decimals byte        `xml:"decimals,attr"`
-	Width    int         `xml:"width,attr"`
-	Label    string      `xml:"label,attr"`
-	Default  string      `xml:"default,attr"`
-	Labels   []*labelXML `xml:"label"`
+	Type     string           `xml:"type,attr"`
+	Name     string           `xml:"name,attr"`
+	Measure  string           `xml:"measure,attr"`
+	Decimals byte             `xml:"decimals,attr"`
+	Width    int              `xml:"width,attr"`
+	Label    string           `xml:"label,attr"`
+	Default  string           `xml:"default,attr"`
+	Weight   bool             `xml:"weight,attr"`
+	Format   string           `xml:"format,attr"`
+	DateFmt  string           `xml:"dateformat,attr"`
+	TimeZone string           `xml:"timezone,attr"`
+	Role     string           `xml:"role,attr"`
+	Template string           `xml:"template,attr"`
+	LabelSet string           `xml:"labels,attr"`
+	Sep      string           `xml:"separator,attr"`
+	Labels   []*labelXML      `xml:"label"`
+	VLabels  []*vlabelXML     `xml:"vlabel"`
+	Missing  []*missingXML    `xml:"missing"`
+	Attrs    []*attrXML       `xml:"attr"`
+	NumFmt   *numberFormatXML `xml:"numberformat"`
+}
+
+type memberXML struct {
+	Name string `xml:"name,attr"`
+}
+
+type mrsetXML struct {
+	Name           string       `xml:"name,attr"`
+	Label          string       `xml:"label,attr"`
+	Type           string       `xml:"type,attr"`
+	Value          string       `xml:"value,attr"`
+	CategoryLabels string       `xml:"categorylabels,attr"`
+	Members        []*memberXML `xml:"member"`
+}
+
+type documentsXML struct {
+	Text string `xml:",chardata"`
 }
 
 type valXML struct {
@@ -51,14 +111,14 @@ type valXML struct {
 	Value string `xml:",chardata"`
 }
 
-func getAttr(element *xml.StartElement, name string) string {
+// getAttr returns the value of an attribute, which the element must have
+func getAttr(element *xml.StartElement, name string) (string, error) {
 	for _, a := range element.Attr {
 		if a.Name.Local == name {
-			return a.Value
+			return a.Value, nil
 		}
 	}
-	log.Fatalf("%s element does not have a %s attribute\n", element.Name.Local, name)
-	return ""
+	return "", &MissingAttrError{element.Name.Local, name}
 }
 
 func hasAttr(element *xml.StartElement, name string) bool {
@@ -70,15 +130,604 @@ func hasAttr(element *xml.StartElement, name string) bool {
 	return false
 }
 
-func parseXSav(in io.Reader, basename string, lengths VarLengths) error {
+// documentLines splits the text of a documents element into lines, removing the
+// indentation and the empty lines at the start and the end
+func documentLines(text string) []string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// makeAttribute checks the name of a custom attribute
+func makeAttribute(attrxml *attrXML) (Attribute, error) {
+	if attrxml.Name == "" || attrxml.Name != cleanVarName(attrxml.Name) {
+		return Attribute{}, fmt.Errorf("Attribute name '%s' is not a valid name", attrxml.Name)
+	}
+	return Attribute{attrxml.Name, attrxml.Value}, nil
+}
+
+// makeNumberFormat checks the separators of a numberformat element
+func makeNumberFormat(nfxml *numberFormatXML) (*NumberFormat, error) {
+	nf := &NumberFormat{nfxml.Decimal, nfxml.Grouping, nfxml.Currency, nfxml.Percent}
+	if nf.Decimal == "" {
+		nf.Decimal = "."
+	}
+	if nf.Decimal == nf.Grouping {
+		return nil, fmt.Errorf("The decimal and grouping separator of a number format can not both be '%s'", nf.Decimal)
+	}
+	if strings.ContainsAny(nf.Decimal+nf.Grouping, "0123456789+-") {
+		return nil, errors.New("The separators of a number format can not be digits or signs")
+	}
+	return nf, nil
+}
+
+// varLabels returns the variable label and its translations in vlabel elements.
+// A vlabel without a language is the label when there is no label attribute.
+func varLabels(varxml *varXML) (string, []Translation) {
+	label := varxml.Label
+	var translations []Translation
+	for _, vl := range varxml.VLabels {
+		if vl.Lang == "" && label == "" {
+			label = vl.Text
+		} else if vl.Lang != "" {
+			translations = append(translations, Translation{vl.Lang, vl.Text})
+		}
+	}
+	return label, translations
+}
+
+// multiVar is a variable of type multi, which holds a list of selected options.
+// It is expanded into one dichotomy variable per option.
+type multiVar struct {
+	separator string
+	options   map[string]string // value of an option to the name of its variable
+	members   []string          // names of the variables in order of the options
+	values    []string          // values of the options
+}
+
+// newMultiVar makes a numeric 0/1 variable for every option of a variable of
+// type multi. The names come from the template, in which {name} is replaced by
+// the name of the multi variable and {value} by the value of the option. The
+// value labels of the option variables are fixed, in English.
+func newMultiVar(varxml *varXML) (*multiVar, []*Var, error) {
+	template := varxml.Template
+	if template == "" {
+		template = "{name}_{value}"
+	}
+	multi := &multiVar{separator: varxml.Sep, options: make(map[string]string)}
+	if multi.separator == "" {
+		multi.separator = ";"
+	}
+
+	var dict []*Var
+	vars := make(map[string]*Var)
+	for _, l := range varxml.Labels {
+		value := strings.TrimSpace(l.Value)
+		if v, found := vars[value]; found {
+			if l.Lang != "" {
+				v.Translations = append(v.Translations, Translation{l.Lang, l.Desc})
+			} else if v.Label == "" {
+				v.Label = l.Desc
+			} else {
+				return nil, nil, fmt.Errorf("Variable %s has a duplicate option %s", varxml.Name, value)
+			}
+			continue
+		}
+		name := strings.NewReplacer("{name}", varxml.Name, "{value}", value).Replace(template)
+
+		v := new(Var)
+		v.Name = name
+		v.Type = SPSS_NUMERIC
+		v.Kind = KindNumeric
+		v.Print = SPSS_FMT_F
+		v.Width = 1
+		v.Decimals = 0
+		v.Measure = SPSS_MLVL_NOM
+		if l.Lang == "" {
+			v.Label = l.Desc
+		} else {
+			v.Translations = []Translation{{l.Lang, l.Desc}}
+		}
+		v.Labels = []Label{{"0", "Not selected", ""}, {"1", "Selected", ""}}
+
+		dict = append(dict, v)
+		vars[value] = v
+		multi.options[value] = name
+		multi.members = append(multi.members, name)
+		multi.values = append(multi.values, value)
+	}
+	if len(multi.members) < 2 {
+		return nil, nil, fmt.Errorf("Variable %s of type multi needs at least two options", varxml.Name)
+	}
+	return multi, dict, nil
+}
+
+// addMultiVar adds the variables of the options of a variable of type multi. It
+// returns the multiple dichotomy set that groups the variables.
+func addMultiVar(out *SpssWriter, varxml *varXML) (*multiVar, *mrsetXML, error) {
+	multi, dict, err := newMultiVar(varxml)
+	if err != nil {
+		return nil, nil, err
+	}
+	label := new(Var)
+	label.Label, label.Translations = varLabels(varxml)
+	mrset := &mrsetXML{Name: varxml.Name, Label: label.label(out.Languages), Type: "dichotomy", Value: "1"}
+	for i, v := range dict {
+		if _, found := out.DictMap[v.Name]; found {
+			return nil, nil, fmt.Errorf("Option %s of variable %s adds duplicate variable %s", multi.values[i], varxml.Name, v.Name)
+		}
+		if err = out.AddVar(v); err != nil {
+			return nil, nil, err
+		}
+		// AddVar cleans v.Name, the dictionary knows the variable by its
+		// generated name
+		mrset.Members = append(mrset.Members, &memberXML{multi.members[i]})
+	}
+	return multi, mrset, nil
+}
+
+// split returns for every variable of the options whether the option is
+// selected in a value, and the options in the value that are unknown
+func (multi *multiVar) split(value string) (map[string]bool, []string) {
+	selected := make(map[string]bool)
+	var unknown []string
+	for _, option := range strings.Split(value, multi.separator) {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if member, found := multi.options[option]; found {
+			selected[member] = true
+		} else {
+			unknown = append(unknown, option)
+		}
+	}
+	return selected, unknown
+}
+
+// setMultiVar sets the variables of the selected options to 1 and the others
+// to 0. Unknown options are a problem in the value, which is ignored when it
+// is tolerated.
+func setMultiVar(out *SpssWriter, name string, multi *multiVar, value string, line, column int) error {
+	selected, unknown := multi.split(value)
+	for _, option := range unknown {
+		err := out.problem(&ValueError{name, value, fmt.Errorf("Unknown option %s", option)}, true,
+			location(out.Name, out.Count+1, line, column), "option ignored")
+		if err != nil {
+			return err
+		}
+	}
+	for _, member := range multi.members {
+		val := "0"
+		if selected[member] {
+			val = "1"
+		}
+		if err := out.SetVarAt(member, val, line, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// booleanLabels returns the value labels of a boolean variable. The labels
+// No and Yes are used for the values that have no label element. The values
+// of label elements can be any spelling of true and false.
+func booleanLabels(labels []*labelXML) ([]Label, error) {
+	result := []Label{{"0", "No", ""}, {"1", "Yes", ""}}
+	for _, l := range labels {
+		f, err := parseBoolean(l.Value)
+		if err != nil {
+			return nil, err
+		}
+		if l.Lang == "" {
+			result[int(f)].Desc = l.Desc
+		} else {
+			result = append(result, Label{formatNumber(f), l.Desc, l.Lang})
+		}
+	}
+	return result, nil
+}
+
+// logRejected logs how many values of each variable could not be parsed, and
+// how many problems were tolerated in the sav
+func logRejected(out *SpssWriter) {
+	total := 0
+	for _, v := range out.Dict {
+		if v.Rejected > 0 {
+			log.Printf("%d values of %s could not be parsed and were set as missing\n", v.Rejected, v.Name)
+			total += v.Rejected
+		}
+	}
+	if total > 0 {
+		log.Printf("In total %d values could not be parsed\n", total)
+	}
+	if out.Problems > 0 {
+		log.Printf("%d problems were tolerated in sav %s\n", out.Problems, out.Name)
+	}
+}
+
+// setMissing checks the missing elements of a variable and stores them as
+// user-missing values. SPSS allows up to three discrete values, a range, or a
+// range and one discrete value. Ranges are only allowed for numeric variables.
+// A string variable without an explicit width is widened to fit its missing
+// values.
+func setMissing(v *Var, missing []*missingXML, explicitWidth bool) error {
+	for _, m := range missing {
+		if m.Low != "" || m.High != "" {
+			if v.Type > 0 {
+				return fmt.Errorf("String variable %s can not have a missing range", v.Name)
+			}
+			if v.HasMissingRange {
+				return fmt.Errorf("Variable %s can only have one missing range", v.Name)
+			}
+			if m.Low == "" || m.High == "" {
+				return fmt.Errorf("Missing range of variable %s needs both a low and a high value", v.Name)
+			}
+			v.MissingLow = m.Low
+			v.MissingHigh = m.High
+			v.HasMissingRange = true
+		} else {
+			v.Missing = append(v.Missing, m.Value)
+		}
+	}
+
+	max := 3
+	if v.HasMissingRange {
+		max = 1
+	}
+	if len(v.Missing) > max {
+		return fmt.Errorf("Variable %s has too many missing values", v.Name)
+	}
+
+	if v.Type > 0 { // string
+		for _, m := range v.Missing {
+			if len(m) > int(v.Type) && len(m) <= 8 && !explicitWidth {
+				v.Type = int32(len(m))
+				if int(v.Width) < len(m) {
+					v.Width = byte(len(m))
+				}
+			}
+			if len(m) > 8 || len(m) > int(v.Type) {
+				return fmt.Errorf("Missing value '%s' of variable %s is too long", m, v.Name)
+			}
+		}
+		return nil
+	}
+
+	values := v.Missing
+	if v.HasMissingRange {
+		values = append([]string{v.MissingLow, v.MissingHigh}, values...)
+	}
+	for _, m := range values {
+		if _, err := strconv.ParseFloat(m, 64); err != nil {
+			return fmt.Errorf("Missing value '%s' of variable %s is not a number", m, v.Name)
+		}
+	}
+	return nil
+}
+
+// addMRSet adds the multiple response set described by an mrset element
+func addMRSet(out *SpssWriter, mrsetxml *mrsetXML) error {
+	m := new(MRSet)
+	m.Name = mrsetxml.Name
+	m.Label = mrsetxml.Label
+	switch mrsetxml.Type {
+	case "dichotomy":
+		m.Dichotomy = true
+		m.CountedValue = mrsetxml.Value
+	case "category":
+	default:
+		return fmt.Errorf("Unknown type %s for multiple response set %s", mrsetxml.Type, m.Name)
+	}
+	switch mrsetxml.CategoryLabels {
+	case "", "varlabels":
+	case "countedvalues":
+		m.CountedLabels = true
+	default:
+		return fmt.Errorf("Unknown value for categorylabels %s", mrsetxml.CategoryLabels)
+	}
+
+	members := make([]string, len(mrsetxml.Members))
+	for i, member := range mrsetxml.Members {
+		members[i] = member.Name
+	}
+	return out.AddMRSet(m, members)
+}
+
+// ParseXSav converts the sav elements of an xsav document to sav files, named
+// after the basename and the sav. The lengths come from pass 1, without them
+// string variables get the default length. Errors are returned as a PosError.
+// When MaxErrors is set and problems in the input were tolerated, a
+// ToleratedError is returned after all sav files were written. Without it the
+// number of tolerated problems is only logged per sav.
+func ParseXSav(in io.Reader, basename string, lengths VarLengths, opts *Options) (err error) {
 	bareBasename := strings.TrimSuffix(basename, filepath.Ext(basename))
 	var filename string
 	var f *os.File
 	var out *SpssWriter
 	var dictDone bool
 	var savname string
+	var weight string
+	var dateformat string
+	var timezone *time.Location
+	var locale string
+	var mrsets []*mrsetXML
+	var multis map[string]*multiVar
+	var labelsets map[string][]*labelXML
+	var caseNr int32
+	var tolerated int
+	decoder := newPositionDecoder(in)
+	defer func() {
+		err = decoder.errorAt(err, savname, caseNr)
+		if err == nil && tolerated > 0 && opts.MaxErrors > 0 {
+			err = &ToleratedError{tolerated}
+		}
+	}()
+	// an unfinished sav file is closed and removed, it is not usable
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(filename)
+		}
+	}()
+
+	// addVar adds the variable of a var element to the dictionary
+	addVar := func(t *xml.StartElement, varxml *varXML) error {
+		var err error
+		if _, found := multis[varxml.Name]; found {
+			return &DuplicateVarError{varxml.Name}
+		}
+		sharedLabels := false
+		if hasAttr(t, "labels") {
+			labels, found := labelsets[varxml.LabelSet]
+			if !found {
+				return fmt.Errorf("Variable %s refers to undefined label set %s", varxml.Name, varxml.LabelSet)
+			}
+			sharedLabels = len(varxml.Labels) == 0
+			varxml.Labels = append(append([]*labelXML(nil), labels...), varxml.Labels...)
+		}
+		if varxml.Type == "multi" {
+			if _, found := out.DictMap[varxml.Name]; found {
+				return &DuplicateVarError{varxml.Name}
+			}
+			multi, mrset, err := addMultiVar(out, varxml)
+			if err != nil {
+				return err
+			}
+			if multis == nil {
+				multis = make(map[string]*multiVar)
+			}
+			multis[varxml.Name] = multi
+			mrsets = append(mrsets, mrset)
+			return nil
+		}
+
+		v := new(Var)
+		v.Name = varxml.Name
+		v.Line, v.Column = decoder.Line, decoder.Column
+		v.Type = SPSS_NUMERIC
+		v.Measure = SPSS_MLVL_NOM
+		varType := varxml.Type
+		var autoWidth, autoDecimals byte
+		if varType == "auto" {
+			if lengths == nil {
+				return fmt.Errorf("The type of variable %s can not be inferred in a single pass", v.Name)
+			}
+			stats, _ := lengths.GetVarStats(savname, v.Name)
+			varType, autoWidth, autoDecimals = stats.inferType()
+			if stats == nil || stats.Count == 0 {
+				log.Printf("Variable %s of type auto has no values, using type numeric\n", v.Name)
+			}
+		}
+		switch varType {
+		case "numeric":
+			v.Decimals = varxml.Decimals
+			v.Print = SPSS_FMT_F
+			v.Width = 8
+			if hasAttr(t, "width") {
+				v.Width = byte(varxml.Width)
+			} else if autoWidth > 0 {
+				v.Width = autoWidth
+			}
+			v.Decimals = 2
+			if hasAttr(t, "decimals") {
+				v.Decimals = byte(varxml.Decimals)
+			} else if autoWidth > 0 {
+				v.Decimals = autoDecimals
+			}
+		case "boolean":
+			v.Kind = KindBoolean
+			v.Print = SPSS_FMT_F
+			v.Width = 1
+			v.Decimals = 0
+		case "date":
+			v.Kind = KindDate
+			v.Print = SPSS_FMT_DATE
+			v.Width = 11
+			v.Decimals = 0
+			v.Measure = SPSS_MLVL_RAT
+		case "datetime":
+			v.Kind = KindDateTime
+			v.Print = SPSS_FMT_DATE_TIME
+			v.Width = 20
+			v.Decimals = 0
+			v.Measure = SPSS_MLVL_RAT
+		case "time":
+			v.Kind = KindTime
+			v.Print = SPSS_FMT_TIME
+			v.Width = 8
+			v.Decimals = 0
+			v.Measure = SPSS_MLVL_RAT
+		case "duration":
+			v.Kind = KindDuration
+			v.Print = SPSS_FMT_DTIME
+			v.Width = 11
+			v.Decimals = 0
+			v.Measure = SPSS_MLVL_RAT
+		default: // string
+			width := opts.DefaultStringLength
+			if hasAttr(t, "width") {
+				width = varxml.Width
+			} else if lengths != nil {
+				width, err = lengths.GetVarLength(savname, v.Name)
+				if err != nil {
+					return err
+				}
+			}
+			v.Kind = KindString
+			v.Type = int32(width)
+			v.Print = SPSS_FMT_A
+			v.Width = byte(width)
+			if width > 40 {
+				v.Width = 40
+			}
+			v.Decimals = 0
+		}
+		if v.Kind == KindDate || v.Kind == KindDateTime {
+			v.DateFormat = dateformat
+			if hasAttr(t, "dateformat") {
+				v.DateFormat = varxml.DateFmt
+			}
+			v.TimeZone = timezone
+			v.Locale = locale
+			if hasAttr(t, "timezone") {
+				if v.TimeZone, err = time.LoadLocation(varxml.TimeZone); err != nil {
+					return fmt.Errorf("Invalid timezone for variable %s: %s", v.Name, err)
+				}
+			}
+		} else if hasAttr(t, "dateformat") || hasAttr(t, "timezone") {
+			return fmt.Errorf("Variable %s is not a date or datetime, it can not have a dateformat or timezone", v.Name)
+		}
+		if varxml.NumFmt != nil {
+			if v.Type != SPSS_NUMERIC || v.Kind != KindNumeric {
+				return fmt.Errorf("Variable %s is not numeric, it can not have a numberformat", v.Name)
+			}
+			if v.NumberFormat, err = makeNumberFormat(varxml.NumFmt); err != nil {
+				return err
+			}
+		}
+		if hasAttr(t, "format") {
+			if v.Print, v.Width, v.Decimals, err = ParseFormat(varxml.Format, v.Kind); err != nil {
+				return fmt.Errorf("Variable %s: %s", v.Name, err)
+			}
+		}
+		if varxml.Type == "auto" {
+			log.Printf("Variable %s of type auto is %s with format %s\n", v.Name, varType, FormatSpec(v.Print, v.Width, v.Decimals))
+		}
+		v.Default = varxml.Default
+		v.HasDefault = hasAttr(t, "default")
+		v.Label, v.Translations = varLabels(varxml)
+		if hasAttr(t, "measure") {
+			switch varxml.Measure {
+			case "scale":
+				v.Measure = SPSS_MLVL_RAT
+			case "nominal":
+				v.Measure = SPSS_MLVL_NOM
+			case "ordinal":
+				v.Measure = SPSS_MLVL_ORD
+			default:
+				return fmt.Errorf("Unknown value for measure %s", varxml.Measure)
+			}
+		}
+		if v.Kind == KindBoolean {
+			if v.Labels, err = booleanLabels(varxml.Labels); err != nil {
+				return fmt.Errorf("Variable %s: %s", v.Name, err)
+			}
+		} else {
+			for _, l := range varxml.Labels {
+				v.Labels = append(v.Labels, Label{l.Value, l.Desc, l.Lang})
+			}
+		}
+		if sharedLabels {
+			v.LabelSet = varxml.LabelSet
+		}
+		if err = setMissing(v, varxml.Missing, hasAttr(t, "width")); err != nil {
+			return err
+		}
+		switch varxml.Role {
+		case "", "input":
+			v.Role = SPSS_ROLE_INPUT
+		case "target":
+			v.Role = SPSS_ROLE_TARGET
+		case "both":
+			v.Role = SPSS_ROLE_BOTH
+		case "none":
+			v.Role = SPSS_ROLE_NONE
+		case "partition":
+			v.Role = SPSS_ROLE_PARTITION
+		case "split":
+			v.Role = SPSS_ROLE_SPLIT
+		default:
+			return fmt.Errorf("Unknown value for role %s", varxml.Role)
+		}
+		for _, a := range varxml.Attrs {
+			attr, err := makeAttribute(a)
+			if err != nil {
+				return err
+			}
+			v.Attributes = append(v.Attributes, attr)
+		}
+		if varxml.Weight {
+			if weight != "" && weight != varxml.Name {
+				return fmt.Errorf("Variable %s can not be the weight, %s already is", varxml.Name, weight)
+			}
+			weight = varxml.Name
+		}
+		return out.AddVar(v)
+	}
+
+	// startCases finishes the dictionary and writes it
+	startCases := func() error {
+		dictDone = true
+		if weight != "" {
+			if err := out.SetWeight(weight); err != nil {
+				return err
+			}
+		}
+		for _, m := range mrsets {
+			if err := addMRSet(out, m); err != nil {
+				return err
+			}
+		}
+		return out.Start(fmt.Sprintf("Export with xml2sav: %s", basename))
+	}
+
+	// inferDict adds a variable of type auto for every variable that has values
+	// in pass 1, for a sav without a dict
+	inferDict := func() error {
+		if len(out.Dict) > 0 {
+			return errors.New("Cases must come after the dictionary")
+		}
+		if lengths == nil {
+			return fmt.Errorf("The dictionary of sav %s can not be inferred in a single pass", savname)
+		}
+		log.Printf("Sav %s has no dictionary, inferring it from the values\n", savname)
+		// the inferred variables have no position of their own
+		decoder.Line, decoder.Column = 0, 0
+		for _, name := range lengths.VarNames(savname) {
+			t := xml.StartElement{Name: xml.Name{Local: "var"}}
+			if err := addVar(&t, &varXML{Name: name, Type: "auto"}); err != nil {
+				return err
+			}
+		}
+		if opts.WriteInferredDict {
+			dictname := fmt.Sprintf("%s_%s_dict.xml", bareBasename, savname)
+			log.Println("Writing", dictname)
+			if err := writeDictFile(dictname, out.Dict); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-	decoder := xml.NewDecoder(in)
 	for {
 		token, err := decoder.Token()
 		if err == io.EOF {
@@ -91,13 +740,45 @@ func parseXSav(in io.Reader, basename string, lengths VarLengths) error {
 		case xml.StartElement:
 			switch t.Name.Local {
 			case "sav":
-				savname = getAttr(&t, "name")
-				filename = fmt.Sprintf("%s_%s.sav", bareBasename, savname)
+				if savname, err = getAttr(&t, "name"); err != nil {
+					return err
+				}
+				ext := "sav"
+				if opts.Compression == SPSS_COMPRESS_ZLIB {
+					ext = "zsav"
+				}
+				filename = fmt.Sprintf("%s_%s.%s", bareBasename, savname, ext)
 				f, err = os.Create(filename)
 				if err != nil {
 					return err
 				}
 				out = NewSpssWriter(f)
+				out.Name = savname
+				out.Compression = opts.Compression
+				out.Languages = opts.Languages
+				out.MaxStringLength = opts.MaxStringLength
+				out.IgnoreMissingVar = opts.IgnoreMissingVar
+				out.Strict = opts.Strict
+				out.MaxErrors = opts.MaxErrors
+				if hasAttr(&t, "weight") {
+					weight, _ = getAttr(&t, "weight")
+				}
+				if hasAttr(&t, "dateformat") {
+					dateformat, _ = getAttr(&t, "dateformat")
+				}
+				locale = opts.Locale
+				if hasAttr(&t, "locale") {
+					locale, _ = getAttr(&t, "locale")
+				}
+				if !IsLocale(locale) {
+					return fmt.Errorf("Unknown locale %s for sav %s", locale, savname)
+				}
+				if hasAttr(&t, "timezone") {
+					tz, _ := getAttr(&t, "timezone")
+					if timezone, err = time.LoadLocation(tz); err != nil {
+						return fmt.Errorf("Invalid timezone for sav %s: %s", savname, err)
+					}
+				}
 				log.Println("Writing", filename)
 			case "var":
 				if dictDone {
@@ -111,92 +792,132 @@ func parseXSav(in io.Reader, basename string, lengths VarLengths) error {
 				if err = decoder.DecodeElement(varxml, &t); err != nil {
 					return err
 				}
-
-				v := new(Var)
-				v.Name = varxml.Name
-				v.Type = SPSS_NUMERIC
-				v.Measure = SPSS_MLVL_NOM
-				switch varxml.Type {
-				case "numeric":
-					v.Decimals = varxml.Decimals
-					v.Print = SPSS_FMT_F
-					v.Width = 8
-					if hasAttr(&t, "width") {
-						v.Width = byte(varxml.Width)
-					}
-					v.Decimals = 2
-					if hasAttr(&t, "decimals") {
-						v.Decimals = byte(varxml.Decimals)
-					}
-				case "date":
-					v.Print = SPSS_FMT_DATE
-					v.Width = 11
-					v.Decimals = 0
-					v.Measure = SPSS_MLVL_RAT
-				case "datetime":
-					v.Print = SPSS_FMT_DATE_TIME
-					v.Width = 20
-					v.Decimals = 0
-					v.Measure = SPSS_MLVL_RAT
-				default: // string
-					width := defaultStringLength
-					if hasAttr(&t, "width") {
-						width = varxml.Width
-					} else if lengths != nil {
-						width, err = lengths.GetVarLength(savname, v.Name)
-						if err != nil {
-							return err
-						}
-					}
-					v.Type = int32(width)
-					v.Print = SPSS_FMT_A
-					v.Width = byte(width)
-					if width > 40 {
-						v.Width = 40
-					}
-					v.Decimals = 0
-				}
-				v.Default = varxml.Default
-				v.HasDefault = hasAttr(&t, "default")
-				v.Label = varxml.Label
-				if hasAttr(&t, "measure") {
-					switch varxml.Measure {
-					case "scale":
-						v.Measure = SPSS_MLVL_RAT
-					case "nominal":
-						v.Measure = SPSS_MLVL_NOM
-					case "ordinal":
-						v.Measure = SPSS_MLVL_ORD
-					default:
-						return fmt.Errorf("Unknown value for measure %s", varxml.Measure)
-					}
+				if err = addVar(&t, varxml); err != nil {
+					return err
+				}
+			case "attr":
+				if dictDone || out == nil {
+					return errors.New("Datafile attributes must be defined before the end of the dictionary")
+				}
+				attrxml := new(attrXML)
+				if err = decoder.DecodeElement(attrxml, &t); err != nil {
+					return err
+				}
+				attr, err := makeAttribute(attrxml)
+				if err != nil {
+					return err
+				}
+				out.Attributes = append(out.Attributes, attr)
+			case "numberformat":
+				if dictDone || out == nil {
+					return errors.New("Number formats must be defined before the end of the dictionary")
 				}
-				for _, l := range varxml.Labels {
-					v.Labels = append(v.Labels, Label{l.Value, l.Desc})
+				var nfxml numberFormatXML
+				if err = decoder.DecodeElement(&nfxml, &t); err != nil {
+					return err
 				}
-				out.AddVar(v)
+				if out.NumberFormat, err = makeNumberFormat(&nfxml); err != nil {
+					return err
+				}
+			case "documents":
+				if dictDone || out == nil {
+					return errors.New("Documents must be defined before the end of the dictionary")
+				}
+				var documentsxml documentsXML
+				if err = decoder.DecodeElement(&documentsxml, &t); err != nil {
+					return err
+				}
+				out.Documents = append(out.Documents, documentLines(documentsxml.Text)...)
+			case "labelset":
+				if dictDone || out == nil {
+					return errors.New("Label sets must be defined in a dictionary")
+				}
+				labelsetxml := new(labelSetXML)
+				if err = decoder.DecodeElement(labelsetxml, &t); err != nil {
+					return err
+				}
+				if labelsetxml.ID == "" {
+					return errors.New("Label set without an id")
+				}
+				if _, found := labelsets[labelsetxml.ID]; found {
+					return fmt.Errorf("Adding duplicate label set %s", labelsetxml.ID)
+				}
+				if labelsets == nil {
+					labelsets = make(map[string][]*labelXML)
+				}
+				labelsets[labelsetxml.ID] = labelsetxml.Labels
+			case "mrset":
+				if dictDone || out == nil {
+					return errors.New("Multiple response sets must be defined in a dictionary")
+				}
+				mrsetxml := new(mrsetXML)
+				if err = decoder.DecodeElement(mrsetxml, &t); err != nil {
+					return err
+				}
+				mrsets = append(mrsets, mrsetxml)
 			case "case":
+				if !dictDone {
+					if err = inferDict(); err != nil {
+						return err
+					}
+					if err = startCases(); err != nil {
+						return err
+					}
+				}
 				out.ClearCase()
+				caseNr = out.Count + 1
 			case "val":
 				var valxml valXML
 				if err = decoder.DecodeElement(&valxml, &t); err != nil {
 					return err
 				}
-				out.SetVar(valxml.Name, valxml.Value)
+				if multi, found := multis[valxml.Name]; found {
+					err = setMultiVar(out, valxml.Name, multi, valxml.Value, decoder.Line, decoder.Column)
+				} else {
+					err = out.SetVarAt(valxml.Name, valxml.Value, decoder.Line, decoder.Column)
+				}
+				if err != nil {
+					return err
+				}
 			}
 		case xml.EndElement:
 			switch t.Name.Local {
 			case "dict":
-				dictDone = true
-				out.Start(fmt.Sprintf("Export with xml2sav: %s", basename))
+				if err = startCases(); err != nil {
+					return err
+				}
 			case "case":
-				out.WriteCase()
+				if err = out.WriteCase(); err != nil {
+					return err
+				}
+				caseNr = 0
 			case "sav":
-				out.Finish()
-				f.Close()
+				if !dictDone {
+					if err = inferDict(); err != nil {
+						return err
+					}
+					if err = startCases(); err != nil {
+						return err
+					}
+				}
+				logRejected(out)
+				tolerated += out.Problems
+				if err = out.Finish(); err != nil {
+					return err
+				}
+				if err = f.Close(); err != nil {
+					return err
+				}
 				f = nil
 				filename = ""
 				savname = ""
+				weight = ""
+				dateformat = ""
+				timezone = nil
+				locale = ""
+				mrsets = nil
+				multis = nil
+				labelsets = nil
 				out = nil
 				dictDone = false
 			}
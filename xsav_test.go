@@ -0,0 +1,331 @@
+/*
+xml2sav - converts a custom xml document to a SPSS binary file.
+Copyright (C) 2016-2017 A.J. Jessurun
+
+This file is part of xml2sav.
+
+Xml2sav is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Xml2sav is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with xml2sav.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package xml2sav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// convertXSav converts an xsav document with a sav named s and returns the
+// sav file
+func convertXSav(t *testing.T, xsav string, opts *Options) []byte {
+	lengths, err := FindVarLengths(strings.NewReader(xsav), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = ParseXSav(strings.NewReader(xsav), filepath.Join(dir, "x.xsav"), lengths, opts); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "x_s.sav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// readXSav converts an xsav document with a sav named s and opens the sav file
+func readXSav(t *testing.T, xsav string, opts *Options) *SpssReader {
+	r, err := NewSpssReader(bytes.NewReader(convertXSav(t, xsav, opts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestMultiVarCleanedNames(t *testing.T) {
+	r := readXSav(t, `<spss><sav name="s"><dict>
+<var type="multi" name="q5" label="Fruit">
+  <label value="-1">None</label>
+  <label value="a b">Apple</label>
+</var>
+</dict>
+<case><val name="q5">a b</val></case>
+</sav></spss>`, DefaultOptions())
+	if len(r.MRSets) != 1 {
+		t.Fatalf("%d multiple response sets, want 1", len(r.MRSets))
+	}
+	var members []string
+	for _, v := range r.MRSets[0].Vars {
+		members = append(members, v.Name)
+	}
+	if got, want := strings.Join(members, ","), "q5_1,q5_ab"; got != want {
+		t.Errorf("members are %s, want %s", got, want)
+	}
+	if err := r.ReadCase(); err != nil {
+		t.Fatal(err)
+	}
+	if none, apple := r.DictMap["q5_1"].Value, r.DictMap["q5_ab"].Value; none != "0" || apple != "1" {
+		t.Errorf("options are %s and %s, want 0 and 1", none, apple)
+	}
+}
+
+func TestMultiVarDuplicateName(t *testing.T) {
+	for _, dict := range []string{
+		`<var name="q5" type="numeric"/><var type="multi" name="q5"><label value="1">A</label><label value="2">B</label></var>`,
+		`<var type="multi" name="q5"><label value="1">A</label><label value="2">B</label></var><var name="q5" type="numeric"/>`,
+		`<var type="multi" name="q5"><label value="1">A</label><label value="2">B</label></var>` +
+			`<var type="multi" name="q5" template="{name}x{value}"><label value="1">A</label><label value="2">B</label></var>`,
+	} {
+		xsav := `<spss><sav name="s"><dict>` + dict + `</dict></sav></spss>`
+		err := ParseXSav(strings.NewReader(xsav), filepath.Join(t.TempDir(), "d.xsav"), nil, DefaultOptions())
+		var duplicate *DuplicateVarError
+		if !errors.As(err, &duplicate) || duplicate.Name != "q5" {
+			t.Errorf("%s: error %v, want a DuplicateVarError for q5", dict, err)
+		}
+	}
+}
+
+func TestLabelSetSharedRecords(t *testing.T) {
+	r := readXSav(t, `<spss><sav name="s"><dict>
+<labelset id="scale"><label value="1">Low</label><label value="2">High</label></labelset>
+<var name="a" type="numeric" labels="scale"/>
+<var name="l" type="string" width="20" labels="scale"/>
+<var name="b" type="numeric" labels="scale"/>
+<var name="c" type="numeric"><label value="1">One</label></var>
+<var name="d" type="numeric" labels="scale"/>
+</dict>
+<case><val name="a">1</val></case>
+</sav></spss>`, DefaultOptions())
+	var types []int32
+	for _, rec := range r.Records {
+		if rec.Type == 3 || rec.Type == 4 {
+			types = append(types, rec.Type)
+		}
+	}
+	if len(types) != 4 || len(r.valueLabels) != 2 {
+		t.Fatalf("value label records %v, want one type 3 and 4 pair for the set and one for c", types)
+	}
+	var indexes []int32
+	for _, name := range []string{"a", "b", "d"} {
+		indexes = append(indexes, r.DictMap[name].Index)
+	}
+	if got := r.valueLabels[0].indexes; fmt.Sprint(got) != fmt.Sprint(indexes) {
+		t.Errorf("label set is used by indexes %v, want %v", got, indexes)
+	}
+	if got := r.valueLabels[1].indexes; len(got) != 1 || got[0] != r.DictMap["c"].Index {
+		t.Errorf("labels of c are used by indexes %v, want only c", got)
+	}
+	if got := len(r.DictMap["l"].Labels); got != 2 {
+		t.Errorf("long string has %d labels, want the 2 of the set", got)
+	}
+}
+
+func TestWeightIndexCountsSegments(t *testing.T) {
+	r := readXSav(t, `<spss><sav name="s" weight="w"><dict>
+<var name="id" type="numeric"/>
+<var name="remark" type="string" width="300"/>
+<var name="name" type="string" width="20"/>
+<var name="w" type="numeric" decimals="2"/>
+</dict>
+<case><val name="id">1</val><val name="w">1.5</val></case>
+</sav></spss>`, DefaultOptions())
+	// id is element 1, the two segments of remark take 32 and 6 elements and
+	// name takes 3
+	if r.weightIndex != 43 {
+		t.Errorf("weight_index is %d, want 43", r.weightIndex)
+	}
+	if r.Weight == nil || r.Weight.Name != "w" {
+		t.Errorf("weight variable is %v, want w", r.Weight)
+	}
+}
+
+func TestMRSetRecords(t *testing.T) {
+	r := readXSav(t, `<spss><sav name="s"><dict>
+<var name="a" type="numeric"/>
+<var name="b" type="numeric"/>
+<var name="c" type="numeric"/>
+<mrset name="cat" label="Fruit" type="category"><member name="a"/><member name="b"/></mrset>
+<mrset name="dich" label="Yes" type="dichotomy" value="1"><member name="b"/><member name="c"/></mrset>
+<mrset name="counted" label="No" type="dichotomy" value="0" categorylabels="countedvalues">
+  <member name="a"/><member name="c"/>
+</mrset>
+</dict>
+<case><val name="a">1</val></case>
+</sav></spss>`, DefaultOptions())
+	records := make(map[int32]string)
+	for _, e := range r.extensions {
+		if e.subtype == 7 || e.subtype == 19 {
+			records[e.subtype] = string(e.data)
+		}
+	}
+	if want := "$cat=C 5 Fruit a b\n$dich=D1 1 3 Yes b c\n"; records[7] != want {
+		t.Errorf("subtype 7 record is %q, want %q", records[7], want)
+	}
+	if want := "$counted=E 1 1 0 2 No a c\n"; records[19] != want {
+		t.Errorf("subtype 19 record is %q, want %q", records[19], want)
+	}
+}
+
+func TestDocumentRecord(t *testing.T) {
+	r := readXSav(t, `<spss><sav name="s"><documents>
+  Wave 1
+  `+strings.Repeat("word ", 20)+`
+</documents><dict><var name="a" type="numeric"/></dict>
+<case><val name="a">1</val></case>
+</sav></spss>`, DefaultOptions())
+	want := []string{"Wave 1", strings.TrimSpace(strings.Repeat("word ", 16)), "word word word word"}
+	if fmt.Sprint(r.Documents) != fmt.Sprint(want) {
+		t.Errorf("documents are %q, want %q", r.Documents, want)
+	}
+	for _, rec := range r.Records {
+		if rec.Type == 6 && rec.Length != 8+80*int64(len(want)) {
+			t.Errorf("document record is %d bytes, want %d lines of 80 bytes", rec.Length, len(want))
+		}
+	}
+}
+
+func TestFormatWords(t *testing.T) {
+	b := convertXSav(t, `<spss><sav name="s"><dict>
+<var name="comma" type="numeric" format="COMMA10.2"/>
+<var name="pct" type="numeric" format="pct8.1"/>
+<var name="e" type="numeric" format="E10.3"/>
+<var name="n" type="numeric" format="N5"/>
+<var name="adate" type="date" format="ADATE10"/>
+<var name="ymdhms" type="datetime" format="YMDHMS19"/>
+<var name="time" type="time" format="TIME8"/>
+<var name="str" type="string" width="20"/>
+</dict>
+<case><val name="comma">1</val></case>
+</sav></spss>`, DefaultOptions())
+	r, err := NewSpssReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int32{
+		"comma":  SPSS_FMT_COMMA<<16 | 10<<8 | 2,
+		"pct":    SPSS_FMT_PCT<<16 | 8<<8 | 1,
+		"e":      SPSS_FMT_E<<16 | 10<<8 | 3,
+		"n":      SPSS_FMT_N<<16 | 5<<8,
+		"adate":  SPSS_FMT_ADATE<<16 | 10<<8,
+		"ymdhms": SPSS_FMT_YMDHMS<<16 | 19<<8,
+		"time":   SPSS_FMT_TIME<<16 | 8<<8,
+		"str":    SPSS_FMT_A<<16 | 20<<8,
+	}
+	seen := 0
+	for _, rec := range r.Records {
+		if rec.Type != 2 || rec.Name == "" { // continuations have no format
+			continue
+		}
+		seen++
+		v := r.ShortMap[rec.Name]
+		var words [2]int32 // print and write
+		binary.Read(bytes.NewReader(b[rec.Offset+16:]), endian, &words)
+		if words[0] != want[v.Name] || words[1] != want[v.Name] {
+			t.Errorf("%s has print %#x and write %#x, want %#x", v.Name, words[0], words[1], want[v.Name])
+		}
+	}
+	if seen != len(want) {
+		t.Errorf("%d variable records, want %d", seen, len(want))
+	}
+}
+
+func TestBooleanLabels(t *testing.T) {
+	tests := []struct {
+		labels []*labelXML
+		want   string // labels as value=desc, with /lang for translations
+	}{
+		{nil, "0=No 1=Yes"},
+		{[]*labelXML{{Value: "true", Desc: "Agree"}}, "0=No 1=Agree"},
+		{[]*labelXML{{Value: "N", Desc: "Disagree"}, {Value: " on ", Desc: "Agree"}}, "0=Disagree 1=Agree"},
+		{[]*labelXML{{Value: "yes", Desc: "Ja", Lang: "nl"}}, "0=No 1=Yes 1=Ja/nl"},
+		{[]*labelXML{{Value: "maybe", Desc: "Maybe"}}, "error"},
+	}
+	for _, test := range tests {
+		labels, err := booleanLabels(test.labels)
+		var got []string
+		for _, l := range labels {
+			s := l.Value + "=" + l.Desc
+			if l.Lang != "" {
+				s += "/" + l.Lang
+			}
+			got = append(got, s)
+		}
+		if err != nil {
+			got = []string{"error"}
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("labels %v give %s, want %s", test.labels, strings.Join(got, " "), test.want)
+		}
+	}
+
+	r := readXSav(t, `<spss><sav name="s"><dict><var name="b" type="boolean"/></dict>
+<case><val name="b">TRUE</val></case><case><val name="b">off</val></case>
+</sav></spss>`, DefaultOptions())
+	v := r.DictMap["b"]
+	if v.Print != SPSS_FMT_F || v.Width != 1 || v.Decimals != 0 || len(v.Labels) != 2 {
+		t.Errorf("boolean has format %s with labels %v, want F1.0 with 2 labels",
+			FormatSpec(v.Print, v.Width, v.Decimals), v.Labels)
+	}
+	for _, want := range []string{"1", "0"} {
+		if err := r.ReadCase(); err != nil || v.Value != want {
+			t.Errorf("value is %s with error %v, want %s", v.Value, err, want)
+		}
+	}
+}
+
+func TestPosErrorPosition(t *testing.T) {
+	xsav := `<spss>
+<sav name="s"><dict><var name="a" type="numeric"/></dict>
+<case><val name="a">1</val></case>
+<case>
+  <val name="a">2</val>  <val name="q17">3</val>
+</case>
+</sav></spss>`
+	convert := map[string]func(string) error{
+		"sav": func(dir string) error {
+			return ParseXSav(strings.NewReader(xsav), filepath.Join(dir, "p.xsav"), nil, DefaultOptions())
+		},
+		"csv": func(dir string) error {
+			return ParseXSavToCsv(strings.NewReader(xsav), filepath.Join(dir, "p.xsav"), nil)
+		},
+	}
+	for name, f := range convert {
+		err := f(t.TempDir())
+		var pos *PosError
+		if !errors.As(err, &pos) {
+			t.Fatalf("%s: error %v, want a PosError", name, err)
+		}
+		if pos.Sav != "s" || pos.Case != 2 || pos.Line != 5 || pos.Column != 26 {
+			t.Errorf("%s: error at sav %s, case %d, line %d, column %d, want sav s, case 2, line 5, column 26",
+				name, pos.Sav, pos.Case, pos.Line, pos.Column)
+		}
+		if want := "sav s, case 2, line 5, column 26: "; !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: message %q does not start with %q", name, err, want)
+		}
+	}
+
+	_, err := FindVarLengths(strings.NewReader(`<spss>
+<sav name="s"><dict>
+  <var type="numeric"/>
+</dict></sav></spss>`), DefaultOptions())
+	var pos *PosError
+	var missing *MissingAttrError
+	if !errors.As(err, &pos) || !errors.As(err, &missing) || pos.Line != 3 || pos.Column != 3 {
+		t.Errorf("pass 1 gives error %v, want a missing name at line 3, column 3", err)
+	}
+}